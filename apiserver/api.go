@@ -6,17 +6,25 @@ package apiserver
 
 import (
 	"bytes"
+	"context"
+	"crypto/subtle"
 	"encoding/csv"
 	"encoding/json"
+	"encoding/xml"
 	"fmt"
 	"io"
-	"log"
 	"math"
 	"math/rand"
+	"mime"
 	"net"
 	"net/http"
 	"net/url"
+	"os"
+	"regexp"
 	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/go-web/httplog"
 	"github.com/go-web/httpmux"
@@ -27,23 +35,144 @@ import (
 )
 
 type apiHandler struct {
-	db   *freegeoip.DB
-	conf *Config
+	db        *freegeoip.DB
+	conf      *Config
+	csvComma  rune
+	languages atomic.Value // *languageGeneration of the current db.
+	updates   *updateStatus
+	metrics   *metrics     // Nil without -metrics.
+	limiter   *rateLimiter // Nil without rate limits.
+	keys      *apiKeys     // Nil without authentication.
+	cors      *cors        // Nil without allowed origins.
+	started   time.Time
 }
 
 // NewHandler creates an http handler for the freegeoip server that
-// can be embedded in other servers.
+// can be embedded in other servers. The handler is also an io.Closer
+// that closes its database, e.g. at the end of a test.
 func NewHandler(c *Config) (http.Handler, error) {
+	h, _, err := newHandler(c)
+	return h, err
+}
+
+// handler is the http.Handler of NewHandler.
+type handler struct {
+	http.Handler
+	db *freegeoip.DB
+}
+
+// Close closes the database and stops its background goroutines.
+func (h *handler) Close() error {
+	h.db.Close()
+	return nil
+}
+
+// newHandler returns the handler of NewHandler and the metrics, nil
+// when disabled, which it serves unless they have their own listener.
+func newHandler(c *Config) (http.Handler, *metrics, error) {
+	comma, err := c.csvComma()
+	if err != nil {
+		return nil, nil, err
+	}
+	prefix, err := c.statusPrefix()
+	if err != nil {
+		return nil, nil, err
+	}
+	cors, err := newCORS(c)
+	if err != nil {
+		return nil, nil, err
+	}
+	proxies, err := c.trustedProxies()
+	if err != nil {
+		return nil, nil, err
+	}
+	if c.ServeDB && c.PeerSecret == "" {
+		return nil, nil, fmt.Errorf("serving the database requires a peer secret")
+	}
+	var keys *apiKeys
+	if c.APIKeysFile != "" {
+		if keys, err = newAPIKeys(c.APIKeysFile); err != nil {
+			return nil, nil, err
+		}
+	}
+	sinks, err := c.eventSinks()
+	if err != nil {
+		return nil, nil, err
+	}
+	updates := &updateStatus{}
+	sinks = append(sinks, updates)
 	db, err := openDB(c)
 	if err != nil {
-		return nil, fmt.Errorf("failed to open database: %v", err)
+		for _, s := range sinks {
+			s.close()
+		}
+		return nil, nil, fmt.Errorf("failed to open database: %v", err)
+	}
+	f := &apiHandler{
+		db:       db,
+		conf:     c,
+		csvComma: comma,
+		updates:  updates,
+		keys:     keys,
+		cors:     cors,
+		started:  time.Now(),
+	}
+	if c.Metrics || c.MetricsAddr != "" {
+		f.metrics = newMetrics(db)
+		sinks = append(sinks, f.metrics)
+	}
+	if c.RateLimit > 0 || c.RateLimitKey > 0 || keys != nil {
+		f.limiter = newRateLimiter(c, proxies)
+	}
+	if keys != nil {
+		go keys.watch(db.NotifyClose())
 	}
-	f := &apiHandler{db: db, conf: c}
 	chain := f.getChain()
 	router := httprouter.New()
-	router.HandlerFunc(http.MethodGet, "/json/:host", buildChain(f.iplookup(jsonWriter), chain...))
-	go watchEvents(db)
-	return router, nil
+	// handle registers an API endpoint, authenticated and rate limited
+	// after the common chain. With CORS, its OPTIONS requests go through
+	// the chain too, which answers preflight requests.
+	handle := func(method, path string, h http.HandlerFunc) {
+		if f.cors != nil {
+			router.HandlerFunc(http.MethodOptions, path,
+				f.instrument(path, buildChain(options(method), chain...)))
+		}
+		// Batches take a token per host, see batch.
+		if f.limiter != nil && path != "/batch" {
+			h = f.limiter.limit(h)
+		}
+		if f.keys != nil {
+			h = f.keys.authenticate(strings.Trim(strings.TrimSuffix(path, ":host"), "/"), f.limiter, h)
+		}
+		router.HandlerFunc(method, path, f.instrument(path, buildChain(h, chain...)))
+	}
+	handle(http.MethodGet, "/csv/:host", f.iplookup(f.csvWriter))
+	handle(http.MethodGet, "/json/:host", f.jsonp(f.iplookup(negotiate(jsonWriter))))
+	handle(http.MethodGet, "/xml/:host", f.iplookup(xmlWriter))
+	if c.BatchMaxSize > 0 {
+		handle(http.MethodPost, "/batch", f.batch)
+	}
+	router.HandlerFunc(http.MethodGet, prefix+"/healthz", f.healthz)
+	router.HandlerFunc(http.MethodGet, prefix+"/readyz", f.readyz)
+	router.HandlerFunc(http.MethodGet, prefix+"/status", f.status)
+	if f.metrics != nil && c.MetricsAddr == "" {
+		router.Handler(http.MethodGet, prefix+"/metrics", f.metrics)
+	}
+	if c.ServeDB {
+		// Peers authenticate with the peer secret, not API keys.
+		router.HandlerFunc(http.MethodGet, "/admin/db",
+			f.instrument("/admin/db", buildChain(f.serveDB, chain...)))
+	}
+	go watchEvents(db, c.instanceID(), sinks...)
+	return &handler{router, db}, f.metrics, nil
+}
+
+// instrument adds the metrics of a route to its handler, if enabled.
+func (f *apiHandler) instrument(route string, h http.HandlerFunc) http.HandlerFunc {
+	if f.metrics == nil {
+		return h
+	}
+	return f.metrics.instrument(route, h)
 }
 
 // buildChain builds the middlware chain recursively, functions are first class
@@ -59,11 +188,17 @@ func buildChain(f http.HandlerFunc, m ...httpmux.MiddlewareFunc) http.HandlerFun
 func (f *apiHandler) getChain() []httpmux.MiddlewareFunc {
 	var chain = []httpmux.MiddlewareFunc{}
 	if f.conf.UseXForwardedFor {
+		if f.limiter != nil {
+			chain = append(chain, savePeer)
+		}
 		chain = append(chain, httplog.UseXForwardedFor)
 	}
 	if !f.conf.Silent {
 		chain = append(chain, httplog.ApacheCombinedFormat(f.conf.accessLogger()))
 	}
+	if f.cors != nil {
+		chain = append(chain, f.cors.handler)
+	}
 	return chain
 }
 
@@ -81,29 +216,207 @@ func (f *apiHandler) iplookup(writer writerFunc) http.HandlerFunc {
 				host = r.RemoteAddr
 			}
 		}
-		ips, err := net.LookupIP(host)
-		if err != nil || len(ips) == 0 {
-			http.NotFound(w, r)
+		at, err := parseTime(r.FormValue("at"))
+		if err != nil {
+			http.Error(w, "Invalid at parameter.", http.StatusBadRequest)
 			return
 		}
-		ip, q := ips[rand.Intn(len(ips))], &geoipQuery{}
-		err = f.db.Lookup(ip, &q.DefaultQuery)
+		fields, err := parseFields(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if key := keyFromContext(r.Context()); key != nil {
+			if fields, err = key.restrictFields(r, fields); err != nil {
+				http.Error(w, err.Error(), http.StatusForbidden)
+				return
+			}
+		}
+		lang, err := requestLanguage(r)
 		if err != nil {
-			http.Error(w, "Try again later.", http.StatusServiceUnavailable)
+			http.Error(w, "Invalid lang parameter.", http.StatusBadRequest)
 			return
 		}
+		resp, lerr := f.lookup(r.Context(), host, at, f.languageMatcher().match(lang))
+		if lerr != nil {
+			if lerr == errHostNotFound {
+				http.NotFound(w, r)
+			} else {
+				http.Error(w, lerr.msg, lerr.status)
+			}
+			return
+		}
+		resp.fields = fields
+		w.Header().Set("Content-Language", contentLanguage(resp))
+		w.Header().Set("X-Content-Type-Options", "nosniff")
 		w.Header().Set("X-Database-Date", f.db.Date().Format(http.TimeFormat))
-		resp := q.Record(ip, r.Header.Get("Accept-Language"))
+		if f.db.Stale() {
+			w.Header().Set("X-Database-Stale", "true")
+		}
 		writer(w, r, resp)
 	}
 }
 
+// lookupError is a failed lookup, with the status and message of its
+// HTTP response.
+type lookupError struct {
+	status int
+	msg    string
+}
+
+var (
+	errHostNotFound = &lookupError{http.StatusNotFound, "Host not found."}
+	errHostTimeout  = &lookupError{http.StatusGatewayTimeout, "Host lookup timed out."}
+)
+
+// lookupIP resolves a host name, replaced by tests.
+var lookupIP = func(ctx context.Context, host string) ([]net.IP, error) {
+	return net.DefaultResolver.LookupIP(ctx, "ip", host)
+}
+
+// lookup resolves host, unless it is an IP address, and returns the
+// record of one of its addresses, from the database build active at
+// the given time if not zero, with names in the given language.
+func (f *apiHandler) lookup(ctx context.Context, host string, at time.Time, lang string) (rr *responseRecord, lerr *lookupError) {
+	if f.metrics != nil {
+		defer func() {
+			f.metrics.lookup(rr, lerr)
+		}()
+	}
+	var err error
+	ips := []net.IP{net.ParseIP(host)}
+	if ips[0] == nil {
+		ips, err = lookupIP(ctx, host)
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, errHostTimeout
+		}
+		if err != nil || len(ips) == 0 {
+			return nil, errHostNotFound
+		}
+	}
+	ip, q := ips[rand.Intn(len(ips))], &geoipQuery{}
+	if at.IsZero() {
+		err = f.db.Lookup(ip, &q.DefaultQuery)
+	} else {
+		err = f.db.LookupAt(ip, at, &q.DefaultQuery)
+	}
+	if err == freegeoip.ErrNoBuild {
+		return nil, &lookupError{http.StatusNotFound, "No database available for the given time."}
+	}
+	if err != nil {
+		return nil, &lookupError{http.StatusServiceUnavailable, "Try again later."}
+	}
+	return q.Record(ip, lang), nil
+}
+
+// requestLanguage returns the language preferences of a request: the
+// lang parameter, which takes the same values as the Accept-Language
+// header, or the header itself.
+func requestLanguage(r *http.Request) (string, error) {
+	v := r.FormValue("lang")
+	if v == "" {
+		return r.Header.Get("Accept-Language"), nil
+	}
+	if _, _, err := language.ParseAcceptLanguage(v); err != nil {
+		return "", err
+	}
+	return v, nil
+}
+
+// serveDB serves the current database file to other instances, see
+// freegeoip.WithPeers.
+func (f *apiHandler) serveDB(w http.ResponseWriter, r *http.Request) {
+	const scheme = "Bearer "
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, scheme) ||
+		subtle.ConstantTimeCompare([]byte(auth[len(scheme):]), []byte(f.conf.PeerSecret)) != 1 {
+		http.Error(w, "Missing or invalid peer secret.", http.StatusUnauthorized)
+		return
+	}
+	checksum := f.db.Checksum()
+	file, err := os.Open(f.db.File())
+	if checksum == "" || err != nil {
+		http.Error(w, "Try again later.", http.StatusServiceUnavailable)
+		return
+	}
+	defer file.Close()
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set(freegeoip.ChecksumHeader, checksum)
+	w.Header().Set("X-Database-Date", f.db.Date().Format(http.TimeFormat))
+	http.ServeContent(w, r, "", f.db.Date(), file)
+}
+
+// parseTime parses the at parameter, either an RFC 3339 timestamp or a
+// plain date. The zero time is returned for an empty value.
+func parseTime(v string) (time.Time, error) {
+	if v == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		t, err = time.Parse("2006-01-02", v)
+	}
+	return t, err
+}
+
+// csvWriter writes the record as a CSV row, preceded by a row with the
+// column names when the header parameter is set. Structured fields are
+// left out of extended responses and can't be selected.
+func (f *apiHandler) csvWriter(w http.ResponseWriter, r *http.Request, d *responseRecord) {
+	fields := csvFields
+	if d.fields != nil {
+		fields = nil
+		for _, field := range d.fields {
+			if !field.structured {
+				fields = append(fields, field)
+			} else if r.FormValue("fields") != "" {
+				http.Error(w, fmt.Sprintf("Field %q is not available in CSV.", field.name),
+					http.StatusBadRequest)
+				return
+			}
+		}
+	}
+	header, _ := strconv.ParseBool(r.FormValue("header"))
+	w.Header().Set("Content-Type", "text/csv")
+	io.WriteString(w, d.csv(f.csvComma, header, fields))
+}
+
+// callbackPattern is the grammar of JSONP callbacks: JavaScript
+// identifiers, optionally separated by dots, e.g. jQuery.cb_1.
+var callbackPattern = regexp.MustCompile(`^[A-Za-z_$][0-9A-Za-z_$]*(\.[A-Za-z_$][0-9A-Za-z_$]*)*$`)
+
+// Maximum length of JSONP callbacks.
+const maxCallbackLen = 128
+
+// jsonp is a middleware that rejects requests with a callback
+// parameter that is not a valid callback, or when JSONP is disabled,
+// before the lookup.
+func (f *apiHandler) jsonp(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if cb := r.FormValue("callback"); cb != "" {
+			if f.conf.DisableJSONP {
+				http.Error(w, "JSONP is disabled.", http.StatusBadRequest)
+				return
+			}
+			if len(cb) > maxCallbackLen || !callbackPattern.MatchString(cb) {
+				http.Error(w, "Invalid callback parameter.", http.StatusBadRequest)
+				return
+			}
+		}
+		next(w, r)
+	}
+}
+
+// jsonWriter writes JSON, or JSONP with the callback parameter, which
+// must have been validated by jsonp. The comment before the callback
+// prevents responses from being interpreted as other content types.
 func jsonWriter(w http.ResponseWriter, r *http.Request, d *responseRecord) {
 	if cb := r.FormValue("callback"); cb != "" {
 		w.Header().Set("Content-Type", "application/javascript")
+		io.WriteString(w, "/**/")
 		io.WriteString(w, cb)
 		w.Write([]byte("("))
-		b, err := json.Marshal(d)
+		b, err := json.Marshal(d.shaped())
 		if err == nil {
 			w.Write(b)
 		}
@@ -111,59 +424,147 @@ func jsonWriter(w http.ResponseWriter, r *http.Request, d *responseRecord) {
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(d)
+	json.NewEncoder(w).Encode(d.shaped())
+}
+
+func xmlWriter(w http.ResponseWriter, r *http.Request, d *responseRecord) {
+	w.Header().Set("Content-Type", "application/xml")
+	io.WriteString(w, xml.Header)
+	x := xml.NewEncoder(w)
+	x.Indent("", "\t")
+	x.Encode(d.shaped())
+	io.WriteString(w, "\n")
+}
+
+// negotiate returns a writerFunc that uses xmlWriter for requests that
+// prefer XML in their Accept header, and the given writer otherwise.
+func negotiate(writer writerFunc) writerFunc {
+	return func(w http.ResponseWriter, r *http.Request, d *responseRecord) {
+		w.Header().Add("Vary", "Accept")
+		if r.FormValue("callback") == "" && prefersXML(r.Header.Get("Accept")) {
+			xmlWriter(w, r, d)
+			return
+		}
+		writer(w, r, d)
+	}
+}
+
+// prefersXML reports whether an Accept header ranks XML above JSON.
+// JSON is kept when it is acceptable through */*, since browsers send
+// application/xml with a higher quality than */* without asking for XML.
+func prefersXML(accept string) bool {
+	jsonQ, rank := acceptQuality(accept, "application/json")
+	if rank == 0 && jsonQ > 0 {
+		return false
+	}
+	appQ, _ := acceptQuality(accept, "application/xml")
+	textQ, _ := acceptQuality(accept, "text/xml")
+	return math.Max(appQ, textQ) > jsonQ
+}
+
+// acceptQuality returns the quality of a media type in an Accept
+// header, given by the most specific media range that matches it as in
+// RFC 7231, or 0 if none does, and the rank of that range: 2 for the
+// media type, 1 for its type/* and 0 for */*.
+func acceptQuality(accept, mediaType string) (float64, int) {
+	q, rank := 0.0, -1
+	group := mediaType[:strings.IndexByte(mediaType, '/')] + "/*"
+	for _, v := range strings.Split(accept, ",") {
+		t, params, err := mime.ParseMediaType(strings.TrimSpace(v))
+		if err != nil {
+			continue
+		}
+		r := -1
+		switch t {
+		case mediaType:
+			r = 2
+		case group:
+			r = 1
+		case "*/*":
+			r = 0
+		}
+		if r > rank {
+			q, rank = 1, r
+			if v, ok := params["q"]; ok {
+				q, _ = strconv.ParseFloat(v, 64)
+			}
+		}
+	}
+	return q, rank
 }
 
 type geoipQuery struct {
 	freegeoip.DefaultQuery
 }
 
+// Record returns the response for ip, with names in the given language,
+// or in English for those that have no translation.
 func (q *geoipQuery) Record(ip net.IP, lang string) *responseRecord {
-	lang = parseAcceptLanguage(lang, q.Country.Names)
-
+	var used, fallback bool
+	name := func(names map[string]string) string {
+		if v := names[lang]; v != "" {
+			used = true
+			return v
+		}
+		if v := names["en"]; v != "" {
+			fallback = true
+			return v
+		}
+		return ""
+	}
 	r := &responseRecord{
 		IP:          ip.String(),
 		CountryCode: q.Country.ISOCode,
-		CountryName: q.Country.Names[lang],
-		City:        q.City.Names[lang],
+		CountryName: name(q.Country.Names),
+		City:        name(q.City.Names),
 		ZipCode:     q.Postal.Code,
 		TimeZone:    q.Location.TimeZone,
 		Latitude:    roundFloat(q.Location.Latitude, .5, 4),
 		Longitude:   roundFloat(q.Location.Longitude, .5, 4),
 		MetroCode:   q.Location.MetroCode,
-		Continent:   q.Continent.Names[lang],
+		Continent:   name(q.Continent.Names),
 	}
+	scope := freegeoip.Classify(ip)
+	r.Reserved = scope.Reserved()
+	r.Scope = string(scope)
 	if len(q.Region) > 0 {
 		r.RegionCode = q.Region[0].ISOCode
-		r.RegionName = q.Region[0].Names[lang]
 	}
-	if val, ok := q.Continent.Names[lang]; ok {
-		r.Continent = val
+	r.Subdivisions = make(subdivisions, len(q.Region))
+	for i, region := range q.Region {
+		r.Subdivisions[i] = subdivision{region.ISOCode, name(region.Names), region.Names}
+	}
+	if len(r.Subdivisions) > 0 {
+		r.RegionName = r.Subdivisions[0].Name
+	}
+	r.Names = recordNames{
+		Continent: q.Continent.Names,
+		Country:   q.Country.Names,
+		City:      q.City.Names,
+	}
+	if used || !fallback {
+		r.langs = append(r.langs, lang)
+	}
+	if fallback && lang != "en" {
+		r.langs = append(r.langs, "en")
 	}
 	return r
 }
 
-func parseAcceptLanguage(header string, dbLangs map[string]string) string {
-	// supported languages -- i.e. languages available in the DB
-	matchLangs := []language.Tag{
-		language.English,
-	}
-
-	// parse available DB languages and add to supported
-	for name := range dbLangs {
-		matchLangs = append(matchLangs, language.Raw.Make(name))
+// contentLanguage returns the Content-Language of records, the
+// languages of their names in the order they first appear.
+func contentLanguage(records ...*responseRecord) string {
+	var langs []string
+	seen := make(map[string]bool)
+	for _, rr := range records {
+		for _, l := range rr.langs {
+			if !seen[l] {
+				seen[l] = true
+				langs = append(langs, l)
+			}
+		}
 	}
-
-	var matcher = language.NewMatcher(matchLangs)
-
-	// parse header
-	t, _, _ := language.ParseAcceptLanguage(header)
-	// match most acceptable language
-	tag, _, _ := matcher.Match(t...)
-	// extract base language
-	base, _ := tag.Base()
-
-	return base.String()
+	return strings.Join(langs, ", ")
 }
 
 func roundFloat(val float64, roundOn float64, places int) (newVal float64) {
@@ -179,63 +580,66 @@ func roundFloat(val float64, roundOn float64, places int) (newVal float64) {
 	return round / pow
 }
 
+// responseRecord is the response of the API. The XML elements are those
+// of the original freegeoip, fields added since are left out of XML
+// unless selected, see responseFields.
 type responseRecord struct {
-	IP          string  `json:"ip"`
-	CountryCode string  `json:"country_code"`
-	CountryName string  `json:"country_name"`
-	RegionCode  string  `json:"region_code"`
-	RegionName  string  `json:"region_name"`
-	City        string  `json:"city"`
-	ZipCode     string  `json:"zip_code"`
-	TimeZone    string  `json:"time_zone"`
-	Latitude    float64 `json:"latitude"`
-	Longitude   float64 `json:"longitude"`
-	MetroCode   uint    `json:"metro_code"`
-	Continent   string  `json:"continent"`
+	XMLName     xml.Name `xml:"Response" json:"-"`
+	IP          string   `json:"ip" xml:"IP"`
+	CountryCode string   `json:"country_code" xml:"CountryCode"`
+	CountryName string   `json:"country_name" xml:"CountryName"`
+	RegionCode  string   `json:"region_code" xml:"RegionCode"`
+	RegionName  string   `json:"region_name" xml:"RegionName"`
+	City        string   `json:"city" xml:"City"`
+	ZipCode     string   `json:"zip_code" xml:"ZipCode"`
+	TimeZone    string   `json:"time_zone" xml:"TimeZone"`
+	Latitude    float64  `json:"latitude" xml:"Latitude"`
+	Longitude   float64  `json:"longitude" xml:"Longitude"`
+	MetroCode   uint     `json:"metro_code" xml:"MetroCode"`
+	Continent   string   `json:"continent" xml:"-"`
+	Reserved    bool     `json:"reserved" xml:"-"`
+	Scope       string   `json:"scope" xml:"-"`
+
+	// Fields of extended responses.
+	Subdivisions subdivisions `json:"-" xml:"-"`
+	Names        recordNames  `json:"-" xml:"-"`
+
+	fields []*responseField // Selected fields, nil for the default.
+	langs  []string         // Languages of the names.
 }
 
 func (rr *responseRecord) String() string {
+	return rr.csv(',', false, csvFields)
+}
+
+// csv renders the given scalar fields of the record as a CSV row with
+// the given delimiter, optionally preceded by a header row.
+func (rr *responseRecord) csv(comma rune, header bool, fields []*responseField) string {
 	b := &bytes.Buffer{}
 	w := csv.NewWriter(b)
+	w.Comma = comma
 	w.UseCRLF = true
-	w.Write([]string{
-		rr.IP,
-		rr.CountryCode,
-		rr.CountryName,
-		rr.RegionCode,
-		rr.RegionName,
-		rr.City,
-		rr.ZipCode,
-		rr.TimeZone,
-		strconv.FormatFloat(rr.Latitude, 'f', 4, 64),
-		strconv.FormatFloat(rr.Longitude, 'f', 4, 64),
-		strconv.Itoa(int(rr.MetroCode)),
-	})
+	if header {
+		w.Write(fieldNames(fields))
+	}
+	row := make([]string, len(fields))
+	for i, f := range fields {
+		row[i] = csvValue(f.value(rr))
+	}
+	w.Write(row)
 	w.Flush()
 	return b.String()
 }
 
 // openDB opens and returns the IP database file or URL.
 func openDB(c *Config) (*freegeoip.DB, error) {
+	opts, err := c.dbOptions()
+	if err != nil {
+		return nil, err
+	}
 	u, err := url.Parse(c.DB)
 	if err != nil || len(u.Scheme) == 0 {
-		return freegeoip.Open(c.DB)
-	}
-	return freegeoip.OpenURL(c.DB)
-}
-
-// watchEvents logs and collect metrics of database events.
-func watchEvents(db *freegeoip.DB) {
-	for {
-		select {
-		case file := <-db.NotifyOpen():
-			log.Println("database loaded:", file)
-		case err := <-db.NotifyError():
-			log.Println("database error:", err)
-		case msg := <-db.NotifyInfo():
-			log.Println("database info:", msg)
-		case <-db.NotifyClose():
-			return
-		}
+		return freegeoip.Open(c.DB, opts...)
 	}
+	return freegeoip.OpenURL(c.DB, opts...)
 }
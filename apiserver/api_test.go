@@ -6,25 +6,52 @@ package apiserver
 
 import (
 	"bytes"
+	"compress/gzip"
 	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
 	"path/filepath"
-	"runtime"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/fiorix/freegeoip"
+	"github.com/fiorix/freegeoip/dbbuild"
+	"github.com/fiorix/freegeoip/internal/testdb"
 )
 
-func newTestHandler() (http.Handler, error) {
-	_, f, _, _ := runtime.Caller(0)
+func newTestConfig(t *testing.T) *Config {
 	c := NewConfig()
-	c.DB = filepath.Join(filepath.Dir(f), "../testdata/db.gz")
+	c.DB = filepath.Join(t.TempDir(), "db.gz")
 	c.Silent = true
-	return NewHandler(c)
+	err := testdb.WriteFile(c.DB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func newTestHandler(t *testing.T) (http.Handler, error) {
+	return openHandler(t, newTestConfig(t))
+}
+
+// openHandler returns the handler of NewHandler, whose database is
+// closed when the test finishes.
+func openHandler(t testing.TB, c *Config) (http.Handler, error) {
+	f, err := NewHandler(c)
+	if err == nil {
+		t.Cleanup(func() { f.(io.Closer).Close() })
+	}
+	return f, err
 }
 
 func TestHandler(t *testing.T) {
-	f, err := newTestHandler()
+	f, err := newTestHandler(t)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -51,6 +78,136 @@ func TestHandler(t *testing.T) {
 	}
 }
 
+func TestCSV(t *testing.T) {
+	for _, tc := range []struct {
+		delimiter string
+		query     string
+		want      string
+	}{
+		{",", "", "8.8.8.8,US,United States,CA,California,Mountain View,94035,America/Los_Angeles,37.3860,-122.0838,807\r\n"},
+		{";", "?header=1", "ip;country_code;country_name;region_code;region_name;city;zip_code;time_zone;latitude;longitude;metro_code\r\n" +
+			"8.8.8.8;US;United States;CA;California;Mountain View;94035;America/Los_Angeles;37.3860;-122.0838;807\r\n"},
+		{`\t`, "", "8.8.8.8\tUS\tUnited States\tCA\tCalifornia\tMountain View\t94035\tAmerica/Los_Angeles\t37.3860\t-122.0838\t807\r\n"},
+	} {
+		c := newTestConfig(t)
+		c.CSVDelimiter = tc.delimiter
+		f, err := openHandler(t, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		f.ServeHTTP(w, httptest.NewRequest("GET", "/csv/8.8.8.8"+tc.query, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Unexpected response: %d %s", w.Code, w.Body.String())
+		}
+		if ct := w.Header().Get("Content-Type"); ct != "text/csv" {
+			t.Errorf("Unexpected content type: %q", ct)
+		}
+		if w.Body.String() != tc.want {
+			t.Errorf("Unexpected CSV:\nhave %q\nwant %q", w.Body.String(), tc.want)
+		}
+	}
+}
+
+func TestCSVInvalidDelimiter(t *testing.T) {
+	for _, v := range []string{"", ";;", "\"", "\n"} {
+		c := newTestConfig(t)
+		c.CSVDelimiter = v
+		if _, err := openHandler(t, c); err == nil {
+			t.Errorf("Unexpected handler with CSV delimiter %q", v)
+		}
+	}
+}
+
+func TestJSONP(t *testing.T) {
+	f, err := newTestHandler(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		callback string
+		code     int
+	}{
+		{"cb", http.StatusOK},
+		{"jQuery.cb_1$", http.StatusOK},
+		{"alert(1);x", http.StatusBadRequest},
+		{"<script>", http.StatusBadRequest},
+		{"a..b", http.StatusBadRequest},
+		{"1cb", http.StatusBadRequest},
+		{strings.Repeat("a", 129), http.StatusBadRequest},
+	} {
+		w := httptest.NewRecorder()
+		f.ServeHTTP(w, httptest.NewRequest("GET", "/json/8.8.8.8?callback="+url.QueryEscape(tc.callback), nil))
+		if w.Code != tc.code {
+			t.Fatalf("Callback %q: unexpected response: %d %s", tc.callback, w.Code, w.Body.String())
+		}
+		if v := w.Header().Get("X-Content-Type-Options"); v != "nosniff" {
+			t.Errorf("Callback %q: unexpected X-Content-Type-Options: %q", tc.callback, v)
+		}
+		if tc.code != http.StatusOK {
+			continue
+		}
+		if ct := w.Header().Get("Content-Type"); ct != "application/javascript" {
+			t.Errorf("Unexpected content type: %q", ct)
+		}
+		body := w.Body.String()
+		if !strings.HasPrefix(body, "/**/"+tc.callback+`({"ip":"8.8.8.8",`) || !strings.HasSuffix(body, "});") {
+			t.Errorf("Unexpected JSONP: %q", body)
+		}
+	}
+}
+
+func TestJSONPDisabled(t *testing.T) {
+	c := newTestConfig(t)
+	c.DisableJSONP = true
+	f, err := openHandler(t, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	f.ServeHTTP(w, httptest.NewRequest("GET", "/json/8.8.8.8?callback=cb", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("Unexpected response: %d %s", w.Code, w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	f.ServeHTTP(w, httptest.NewRequest("GET", "/json/8.8.8.8", nil))
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("Unexpected response: %d %v", w.Code, w.Header())
+	}
+}
+
+func TestStale(t *testing.T) {
+	for _, tc := range []struct {
+		maxAge        time.Duration
+		staleNotReady bool
+		header        string
+		ready         int
+	}{
+		{0, true, "", http.StatusOK},
+		{24 * time.Hour, false, "true", http.StatusOK},
+		{24 * time.Hour, true, "true", http.StatusServiceUnavailable},
+		{100 * 365 * 24 * time.Hour, true, "", http.StatusOK},
+	} {
+		c := newTestConfig(t)
+		c.DBMaxAge = tc.maxAge
+		c.StaleNotReady = tc.staleNotReady
+		f, err := openHandler(t, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		f.ServeHTTP(w, httptest.NewRequest("GET", "/json/8.8.8.8", nil))
+		if v := w.Header().Get("X-Database-Stale"); v != tc.header {
+			t.Errorf("max age %s: unexpected X-Database-Stale: %q", tc.maxAge, v)
+		}
+		w = httptest.NewRecorder()
+		f.ServeHTTP(w, httptest.NewRequest("GET", "/readyz", nil))
+		if w.Code != tc.ready {
+			t.Errorf("max age %s: unexpected /readyz status: %d", tc.maxAge, w.Code)
+		}
+	}
+}
+
 func TestParseAcceptLanguage(t *testing.T) {
 	var names = make(map[string]string)
 	names["en"] = "Romania"
@@ -73,12 +230,198 @@ func TestParseAcceptLanguage(t *testing.T) {
 	// no languages
 	names = make(map[string]string)
 	testParseAcceptLanguage(t, names, "fr-CH, fr;q=0.9, en;q=0.8, de;q=0.7, *;q=0.5", "en")
+
+	// regional languages
+	names = make(map[string]string)
+	names["en"] = "Romania"
+	names["pt-BR"] = "Romênia"
+	names["zh-CN"] = "罗马尼亚"
+	testParseAcceptLanguage(t, names, "pt-BR", "pt-BR")
+	testParseAcceptLanguage(t, names, "pt", "pt-BR")
+	testParseAcceptLanguage(t, names, "zh-CN, en;q=0.5", "zh-CN")
+}
+
+func TestLang(t *testing.T) {
+	f, err := newTestHandler(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 8.8.8.8 has no German or French city name, those are in English.
+	for _, tc := range []struct {
+		query, accept string
+		status        int
+		lang, country string
+		city          string
+	}{
+		{"", "", http.StatusOK, "en", "United States", "Mountain View"},
+		{"", "de", http.StatusOK, "de, en", "USA", "Mountain View"},
+		{"?lang=fr", "de", http.StatusOK, "fr, en", "États-Unis", "Mountain View"},
+		{"?lang=" + url.QueryEscape("ja,de;q=0.5"), "", http.StatusOK, "ja", "アメリカ合衆国", "マウンテンビュー"},
+		{"?lang=ko", "de", http.StatusOK, "en", "United States", "Mountain View"},
+		{"?lang=" + url.QueryEscape("!!"), "", http.StatusBadRequest, "", "", ""},
+	} {
+		r := httptest.NewRequest("GET", "/json/8.8.8.8"+tc.query, nil)
+		r.Header.Set("Accept-Language", tc.accept)
+		w := httptest.NewRecorder()
+		f.ServeHTTP(w, r)
+		if w.Code != tc.status {
+			t.Fatalf("%q: unexpected response: %d %s", tc.query, w.Code, w.Body.String())
+		}
+		if tc.status != http.StatusOK {
+			continue
+		}
+		if v := w.Header().Get("Content-Language"); v != tc.lang {
+			t.Errorf("%q: unexpected Content-Language: %q", tc.query, v)
+		}
+		var m struct {
+			CountryName string `json:"country_name"`
+			City        string `json:"city"`
+		}
+		if err = json.NewDecoder(w.Body).Decode(&m); err != nil {
+			t.Fatal(err)
+		}
+		if m.CountryName != tc.country {
+			t.Errorf("%q: unexpected country name: %q", tc.query, m.CountryName)
+		}
+		if m.City != tc.city {
+			t.Errorf("%q: unexpected city: %q", tc.query, m.City)
+		}
+	}
 }
 
 func testParseAcceptLanguage(t *testing.T, names map[string]string, header string, language string) {
-	result := parseAcceptLanguage(header, names)
+	var langs []string
+	for name := range names {
+		langs = append(langs, name)
+	}
+	result := newLanguageMatcher(langs).match(header)
 
 	if result != language {
 		t.Fatalf("Parsed language '%s' from header '%s'  doesn't match language '%s'", result, header, language)
 	}
 }
+
+func TestLanguageReload(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "db.gz")
+	if err := testdb.WriteFile(file); err != nil {
+		t.Fatal(err)
+	}
+	db, err := freegeoip.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	<-db.NotifyOpen()
+	f := &apiHandler{db: db}
+	m := f.languageMatcher()
+	if f.languageMatcher() != m {
+		t.Fatal("Unexpected new matcher for the same database")
+	}
+	if lang := m.match("es"); lang != "en" {
+		t.Fatalf("Unexpected language: %q", lang)
+	}
+
+	w := dbbuild.NewWriter(dbbuild.Metadata{
+		DatabaseType: "Test-City",
+		Languages:    []string{"en", "es"},
+	})
+	_, network, _ := net.ParseCIDR("8.8.8.0/24")
+	loc := dbbuild.Location{
+		CountryCode:  "US",
+		CountryNames: map[string]string{"en": "United States", "es": "Estados Unidos"},
+	}
+	if err = w.Insert(network, loc.Record()); err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	gz := gzip.NewWriter(&b)
+	w.WriteTo(gz)
+	gz.Close()
+	if err = ioutil.WriteFile(file+".tmp", b.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Rename(file+".tmp", file); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-db.NotifyOpen():
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the reload")
+	}
+	if lang := f.languageMatcher().match("es"); lang != "es" {
+		t.Fatalf("Unexpected language after a reload: %q", lang)
+	}
+}
+
+func TestRecordScope(t *testing.T) {
+	for _, tc := range []struct {
+		ip       string
+		scope    string
+		reserved bool
+	}{
+		{"8.8.8.8", "global", false},
+		{"10.0.0.1", "private", true},
+		{"127.0.0.1", "loopback", true},
+		{"fe80::1", "link-local", true},
+	} {
+		q := &geoipQuery{}
+		r := q.Record(net.ParseIP(tc.ip), "")
+		if r.Scope != tc.scope || r.Reserved != tc.reserved {
+			t.Errorf("%s: want scope=%q reserved=%t, have scope=%q reserved=%t",
+				tc.ip, tc.scope, tc.reserved, r.Scope, r.Reserved)
+		}
+	}
+}
+
+func TestParseTime(t *testing.T) {
+	for _, v := range []string{"", "2022-04-01", "2022-04-01T10:00:00Z", "2022-04-01T10:00:00+02:00"} {
+		if _, err := parseTime(v); err != nil {
+			t.Errorf("%q: %v", v, err)
+		}
+	}
+	for _, v := range []string{"yesterday", "2022-13-01", "1648800000"} {
+		if _, err := parseTime(v); err == nil {
+			t.Errorf("%q: unexpected valid time", v)
+		}
+	}
+}
+
+const benchmarkAcceptLanguage = "fr-CH, fr;q=0.9, en;q=0.8, de;q=0.7, *;q=0.5"
+
+// BenchmarkLanguageMatcherUncached is the cost of building a matcher
+// for each request, for comparison with BenchmarkLanguageMatcher.
+func BenchmarkLanguageMatcherUncached(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		newLanguageMatcher(testdb.Languages).match(benchmarkAcceptLanguage)
+	}
+}
+
+func BenchmarkLanguageMatcher(b *testing.B) {
+	m := newLanguageMatcher(testdb.Languages)
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			m.match(benchmarkAcceptLanguage)
+		}
+	})
+}
+
+func BenchmarkHandler(b *testing.B) {
+	c := NewConfig()
+	c.DB = filepath.Join(b.TempDir(), "db.gz")
+	c.Silent = true
+	if err := testdb.WriteFile(c.DB); err != nil {
+		b.Fatal(err)
+	}
+	f, err := openHandler(b, c)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			r := httptest.NewRequest("GET", "/json/8.8.8.8", nil)
+			r.Header.Set("Accept-Language", benchmarkAcceptLanguage)
+			f.ServeHTTP(httptest.NewRecorder(), r)
+		}
+	})
+}
@@ -0,0 +1,202 @@
+// Copyright 2009 The freegeoip authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package apiserver
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+// Interval between checks of the API keys file for changes.
+var apiKeysReloadInterval = 10 * time.Second
+
+// apiKey is an API key and its policy, as in the keys file.
+type apiKey struct {
+	Key            string   `json:"key"`
+	Name           string   `json:"name"`             // In access logs, a hash of the key if empty.
+	RateLimit      float64  `json:"rate_limit"`       // Requests per second, -rate-limit-key if 0.
+	RateLimitBurst int      `json:"rate_limit_burst"` // -rate-limit-burst if 0.
+	Endpoints      []string `json:"endpoints"`        // Allowed endpoints, e.g. json, all if empty.
+	Fields         []string `json:"fields"`           // Allowed fields, all if empty.
+
+	fields map[string]bool
+}
+
+// allows reports whether the key can use an endpoint.
+func (k *apiKey) allows(endpoint string) bool {
+	if len(k.Endpoints) == 0 {
+		return true
+	}
+	for _, e := range k.Endpoints {
+		if e == endpoint {
+			return true
+		}
+	}
+	return false
+}
+
+// restrictFields returns the selected fields of a request if the key
+// allows them, or the allowed ones of the default response.
+func (k *apiKey) restrictFields(r *http.Request, fields []*responseField) ([]*responseField, error) {
+	if k.fields == nil {
+		return fields, nil
+	}
+	explicit := r.FormValue("fields") != ""
+	if fields == nil {
+		fields = defaultFields
+	}
+	var allowed []*responseField
+	for _, f := range fields {
+		if k.fields[f.name] {
+			allowed = append(allowed, f)
+		} else if explicit {
+			return nil, fmt.Errorf("Field %q is not allowed for this key.", f.name)
+		}
+	}
+	return allowed, nil
+}
+
+// readAPIKeys reads a keys file, a JSON array of keys.
+func readAPIKeys(name string) (map[[sha256.Size]byte]*apiKey, error) {
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	var list []*apiKey
+	if err = json.Unmarshal(b, &list); err != nil {
+		return nil, fmt.Errorf("invalid API keys file %s: %v", name, err)
+	}
+	keys := make(map[[sha256.Size]byte]*apiKey, len(list))
+	for i, k := range list {
+		if k.Key == "" {
+			return nil, fmt.Errorf("invalid API keys file %s: key %d is empty", name, i)
+		}
+		sum := sha256.Sum256([]byte(k.Key))
+		if k.Name == "" {
+			k.Name = fmt.Sprintf("%x", sum[:4])
+		}
+		for _, f := range k.Fields {
+			if responseFieldsByName[f] == nil {
+				return nil, fmt.Errorf("invalid API keys file %s: unknown field %q", name, f)
+			}
+			if k.fields == nil {
+				k.fields = make(map[string]bool)
+			}
+			k.fields[f] = true
+		}
+		keys[sum] = k
+	}
+	return keys, nil
+}
+
+// apiKeys are the keys of a keys file, reloaded when it changes.
+type apiKeys struct {
+	file     string
+	interval time.Duration // Between checks of the file.
+	mu       sync.RWMutex
+	keys     map[[sha256.Size]byte]*apiKey // By hash of the key.
+	modtime  time.Time
+	size     int64
+}
+
+func newAPIKeys(file string) (*apiKeys, error) {
+	k := &apiKeys{file: file, interval: apiKeysReloadInterval}
+	if err := k.load(); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// load reads the keys file if it changed since the last load.
+func (k *apiKeys) load() error {
+	stat, err := os.Stat(k.file)
+	if err != nil {
+		return err
+	}
+	k.mu.RLock()
+	changed := !stat.ModTime().Equal(k.modtime) || stat.Size() != k.size
+	k.mu.RUnlock()
+	if !changed {
+		return nil
+	}
+	keys, err := readAPIKeys(k.file)
+	if err != nil {
+		return err
+	}
+	k.mu.Lock()
+	k.keys, k.modtime, k.size = keys, stat.ModTime(), stat.Size()
+	k.mu.Unlock()
+	return nil
+}
+
+// watch reloads the keys file when it changes, until quit is closed.
+// Invalid files are logged and the previous keys are kept.
+func (k *apiKeys) watch(quit <-chan struct{}) {
+	ticker := time.NewTicker(k.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := k.load(); err != nil {
+				log.Println("API keys not reloaded:", err)
+			}
+		case <-quit:
+			return
+		}
+	}
+}
+
+func (k *apiKeys) lookup(key string) *apiKey {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.keys[sha256.Sum256([]byte(key))]
+}
+
+type apiKeyContextKey struct{}
+
+// keyFromContext returns the API key of an authenticated request, or
+// nil.
+func keyFromContext(ctx context.Context) *apiKey {
+	k, _ := ctx.Value(apiKeyContextKey{}).(*apiKey)
+	return k
+}
+
+// authenticate is a middleware that requires an API key that allows
+// the endpoint. The name of the key is set as the user of the request
+// URL for access logs, and the key parameter is removed so that it is
+// not logged. Failed attempts take a token from the bucket of the
+// client IP in limiter, if not nil, so that keys can't be guessed
+// faster than the IP rate limit.
+func (k *apiKeys) authenticate(endpoint string, limiter *rateLimiter, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := k.lookup(requestAPIKey(r))
+		if key == nil {
+			if limiter != nil && !limiter.take(w, r, 1) {
+				return
+			}
+			http.Error(w, "Missing or invalid API key.", http.StatusUnauthorized)
+			return
+		}
+		r.URL.User = url.User(key.Name)
+		if q := r.URL.Query(); q.Get("key") != "" {
+			q.Del("key")
+			r.URL.RawQuery = q.Encode()
+		}
+		if !key.allows(endpoint) {
+			http.Error(w, "Endpoint not allowed for this API key.", http.StatusForbidden)
+			return
+		}
+		next(w, r.WithContext(context.WithValue(r.Context(), apiKeyContextKey{}, key)))
+	}
+}
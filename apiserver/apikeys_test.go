@@ -0,0 +1,177 @@
+// Copyright 2009 The freegeoip authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package apiserver
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-web/httplog"
+)
+
+func writeAPIKeys(t *testing.T, file, keys string) {
+	t.Helper()
+	if err := ioutil.WriteFile(file+".tmp", []byte(keys), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(file+".tmp", file); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAPIKeys(t *testing.T) {
+	c := newTestConfig(t)
+	c.APIKeysFile = filepath.Join(t.TempDir(), "keys.json")
+	writeAPIKeys(t, c.APIKeysFile, `[
+		{"key": "k1", "name": "team-a"},
+		{"key": "k2", "endpoints": ["csv"], "fields": ["country_code", "city"]},
+		{"key": "k3", "rate_limit": 1, "rate_limit_burst": 1}
+	]`)
+	f, err := openHandler(t, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		path, key string
+		code      int
+		body      string
+	}{
+		{"/json/8.8.8.8", "", http.StatusUnauthorized, ""},
+		{"/json/8.8.8.8", "nope", http.StatusUnauthorized, ""},
+		{"/json/8.8.8.8", "k1", http.StatusOK, ""},
+		{"/json/8.8.8.8?key=k1", "", http.StatusOK, ""},
+		{"/json/8.8.8.8", "k2", http.StatusForbidden, ""},
+		{"/csv/8.8.8.8", "k2", http.StatusOK, "US,Mountain View\r\n"},
+		{"/csv/8.8.8.8?fields=city", "k2", http.StatusOK, "Mountain View\r\n"},
+		{"/csv/8.8.8.8?fields=city,zip_code", "k2", http.StatusForbidden, ""},
+		{"/json/8.8.8.8", "k3", http.StatusOK, ""},
+		{"/json/8.8.8.8", "k3", http.StatusTooManyRequests, ""},
+		{"/readyz", "", http.StatusOK, ""},
+	} {
+		r := httptest.NewRequest("GET", tc.path, nil)
+		if tc.key != "" {
+			r.Header.Set("X-API-Key", tc.key)
+		}
+		w := httptest.NewRecorder()
+		f.ServeHTTP(w, r)
+		if w.Code != tc.code {
+			t.Fatalf("%s with key %q: unexpected response: %d %s", tc.path, tc.key, w.Code, w.Body.String())
+		}
+		if tc.body != "" && w.Body.String() != tc.body {
+			t.Errorf("%s with key %q: unexpected body: %q", tc.path, tc.key, w.Body.String())
+		}
+	}
+}
+
+func TestAPIKeysGuessing(t *testing.T) {
+	c := newTestConfig(t)
+	c.RateLimit = 1
+	c.RateLimitBurst = 2
+	c.APIKeysFile = filepath.Join(t.TempDir(), "keys.json")
+	writeAPIKeys(t, c.APIKeysFile, `[{"key": "k1", "rate_limit": 1}]`)
+	f, err := openHandler(t, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, tc := range []struct {
+		key  string
+		code int
+	}{
+		{"guess1", http.StatusUnauthorized},
+		{"guess2", http.StatusUnauthorized},
+		{"guess3", http.StatusTooManyRequests},
+		{"", http.StatusTooManyRequests},
+		{"k1", http.StatusOK}, // Limited by key, not by IP.
+	} {
+		r := httptest.NewRequest("GET", "/json/8.8.8.8", nil)
+		r.Header.Set("X-API-Key", tc.key)
+		w := httptest.NewRecorder()
+		f.ServeHTTP(w, r)
+		if w.Code != tc.code {
+			t.Fatalf("Request %d with key %q: unexpected status: %d", i, tc.key, w.Code)
+		}
+	}
+}
+
+func TestAPIKeysAccessLog(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "keys.json")
+	writeAPIKeys(t, file, `[{"key": "secret", "name": "team-a"}]`)
+	keys, err := newAPIKeys(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var logs bytes.Buffer
+	h := buildChain(keys.authenticate("json", nil, func(w http.ResponseWriter, r *http.Request) {}),
+		httplog.ApacheCombinedFormat(log.New(&logs, "", 0)))
+	h(httptest.NewRecorder(), httptest.NewRequest("GET", "/json/8.8.8.8?key=secret&lang=de", nil))
+	line := logs.String()
+	if !strings.Contains(line, " - team-a [") || !strings.Contains(line, "GET /json/8.8.8.8?lang=de ") {
+		t.Errorf("Unexpected access log: %q", line)
+	}
+	if strings.Contains(line, "secret") {
+		t.Errorf("Key in access log: %q", line)
+	}
+}
+
+func TestAPIKeysReload(t *testing.T) {
+	defer func(d time.Duration) { apiKeysReloadInterval = d }(apiKeysReloadInterval)
+	apiKeysReloadInterval = 10 * time.Millisecond
+	c := newTestConfig(t)
+	c.APIKeysFile = filepath.Join(t.TempDir(), "keys.json")
+	writeAPIKeys(t, c.APIKeysFile, `[{"key": "old"}]`)
+	f, err := openHandler(t, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeAPIKeys(t, c.APIKeysFile, `[{"key": "new", "name": "rotated"}]`)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		r := httptest.NewRequest("GET", "/json/8.8.8.8", nil)
+		r.Header.Set("X-API-Key", "new")
+		w := httptest.NewRecorder()
+		f.ServeHTTP(w, r)
+		if w.Code == http.StatusOK {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for the keys to be reloaded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Invalid files are ignored.
+	writeAPIKeys(t, c.APIKeysFile, `[{"key": "broken"`)
+	time.Sleep(50 * time.Millisecond)
+	r := httptest.NewRequest("GET", "/json/8.8.8.8", nil)
+	r.Header.Set("X-API-Key", "new")
+	w := httptest.NewRecorder()
+	f.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Unexpected status after an invalid reload: %d", w.Code)
+	}
+}
+
+func TestAPIKeysInvalid(t *testing.T) {
+	for _, keys := range []string{
+		`{"key": "k1"}`,
+		`[{"key": ""}]`,
+		`[{"key": "k1", "fields": ["foo"]}]`,
+	} {
+		c := newTestConfig(t)
+		c.APIKeysFile = filepath.Join(t.TempDir(), "keys.json")
+		writeAPIKeys(t, c.APIKeysFile, keys)
+		if _, err := openHandler(t, c); err == nil {
+			t.Errorf("Unexpected handler with keys %s", keys)
+		}
+	}
+}
@@ -0,0 +1,197 @@
+// Copyright 2009 The freegeoip authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package apiserver
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Maximum size of a host in a batch request, to bound the request body.
+	maxBatchHostLen = 256
+
+	// Host names of a batch resolved concurrently.
+	batchResolvers = 16
+)
+
+// Time allowed to resolve the host names of a batch, at most half the
+// write timeout so that the response can still be written. Names not
+// resolved by then get an error.
+var batchResolveTimeout = 5 * time.Second
+
+// batchItem is the result of one host of a batch request. It has the
+// fields of responseRecord, or an error.
+type batchItem struct {
+	Query string `json:"query"`
+	*responseRecord
+	Error string `json:"error,omitempty"`
+}
+
+// MarshalJSON encodes the item with the selected fields of its record,
+// between the query and the error.
+func (item batchItem) MarshalJSON() ([]byte, error) {
+	query, err := json.Marshal(item.Query)
+	if err != nil {
+		return nil, err
+	}
+	b := append([]byte(`{"query":`), query...)
+	if rr := item.responseRecord; rr != nil {
+		fields := rr.fields
+		if fields == nil {
+			fields = defaultFields
+		}
+		b, err = shapedRecord{rr, fields}.appendJSON(b)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if item.Error != "" {
+		msg, err := json.Marshal(item.Error)
+		if err != nil {
+			return nil, err
+		}
+		b = append(append(b, `,"error":`...), msg...)
+	}
+	return append(b, '}'), nil
+}
+
+// batch looks up a list of hosts, sent as a JSON array of strings or
+// one per line, and returns their results in the same order.
+func (f *apiHandler) batch(w http.ResponseWriter, r *http.Request) {
+	at, err := parseTime(r.FormValue("at"))
+	if err != nil {
+		http.Error(w, "Invalid at parameter.", http.StatusBadRequest)
+		return
+	}
+	fields, err := parseFields(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if key := keyFromContext(r.Context()); key != nil {
+		if fields, err = key.restrictFields(r, fields); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+	}
+	pref, err := requestLanguage(r)
+	if err != nil {
+		http.Error(w, "Invalid lang parameter.", http.StatusBadRequest)
+		return
+	}
+	max := f.conf.BatchMaxSize
+	body := http.MaxBytesReader(w, r.Body, int64(max)*(maxBatchHostLen+4)+2)
+	hosts, err := readBatch(body)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid batch: %v.", err), http.StatusBadRequest)
+		return
+	}
+	if len(hosts) > max {
+		http.Error(w, fmt.Sprintf("Too many hosts, the maximum is %d.", max),
+			http.StatusRequestEntityTooLarge)
+		return
+	}
+	if f.limiter != nil && !f.limiter.take(w, r, len(hosts)) {
+		return
+	}
+	lang := f.languageMatcher().match(pref)
+	items := make([]batchItem, len(hosts))
+	timeout := batchResolveTimeout
+	if wt := f.conf.WriteTimeout / 2; wt > 0 && wt < timeout {
+		timeout = wt
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+	lookup := func(i int) {
+		items[i].Query = hosts[i]
+		resp, lerr := f.lookup(ctx, hosts[i], at, lang)
+		if lerr != nil {
+			items[i].Error = lerr.msg
+			return
+		}
+		resp.fields = fields
+		items[i].responseRecord = resp
+	}
+	// Addresses need no DNS, names are resolved by a pool of workers.
+	names := make(chan int, len(hosts))
+	for i, host := range hosts {
+		if net.ParseIP(host) != nil {
+			lookup(i)
+		} else {
+			names <- i
+		}
+	}
+	close(names)
+	var wg sync.WaitGroup
+	for n := 0; n < batchResolvers && n < len(names); n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range names {
+				lookup(i)
+			}
+		}()
+	}
+	wg.Wait()
+	records := make([]*responseRecord, 0, len(hosts))
+	for _, item := range items {
+		if item.responseRecord != nil {
+			records = append(records, item.responseRecord)
+		}
+	}
+	if v := contentLanguage(records...); v != "" {
+		lang = v
+	}
+	w.Header().Set("Content-Language", lang)
+	w.Header().Set("X-Database-Date", f.db.Date().Format(http.TimeFormat))
+	if f.db.Stale() {
+		w.Header().Set("X-Database-Stale", "true")
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(items)
+}
+
+// readBatch reads the hosts of a batch request.
+func readBatch(r io.Reader) ([]string, error) {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	b = bytes.TrimSpace(b)
+	var hosts []string
+	if bytes.HasPrefix(b, []byte("[")) {
+		err = json.Unmarshal(b, &hosts)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		s := bufio.NewScanner(bytes.NewReader(b))
+		for s.Scan() {
+			if host := strings.TrimSpace(s.Text()); host != "" {
+				hosts = append(hosts, host)
+			}
+		}
+		if err = s.Err(); err != nil {
+			return nil, err
+		}
+	}
+	for _, host := range hosts {
+		if host == "" || len(host) > maxBatchHostLen {
+			return nil, fmt.Errorf("invalid host %q", host)
+		}
+	}
+	return hosts, nil
+}
@@ -0,0 +1,161 @@
+// Copyright 2009 The freegeoip authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package apiserver
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBatch(t *testing.T) {
+	f, err := newTestHandler(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, body := range []string{
+		`["8.8.8.8", "not a host", "200.1.2.3"]`,
+		"8.8.8.8\nnot a host\r\n\n200.1.2.3\n",
+	} {
+		r := httptest.NewRequest("POST", "/batch", strings.NewReader(body))
+		r.Header.Set("Accept-Language", "de")
+		w := httptest.NewRecorder()
+		f.ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Unexpected response: %d %s", w.Code, w.Body.String())
+		}
+		var items []struct {
+			Query       string `json:"query"`
+			CountryName string `json:"country_name"`
+			City        string `json:"city"`
+			Error       string `json:"error"`
+		}
+		if err = json.NewDecoder(w.Body).Decode(&items); err != nil {
+			t.Fatal(err)
+		}
+		if len(items) != 3 ||
+			items[0].Query != "8.8.8.8" || items[0].CountryName != "USA" || items[0].Error != "" ||
+			items[1].Query != "not a host" || items[1].Error == "" || items[1].CountryName != "" ||
+			items[2].Query != "200.1.2.3" || items[2].City != "Caracas" {
+			t.Fatalf("Unexpected items: %+v", items)
+		}
+	}
+}
+
+func TestBatchLimits(t *testing.T) {
+	c := newTestConfig(t)
+	c.BatchMaxSize = 2
+	f, err := openHandler(t, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for body, code := range map[string]int{
+		`["8.8.8.8", "8.8.4.4"]`:            http.StatusOK,
+		`["8.8.8.8", "8.8.4.4", "1.1.1.1"]`: http.StatusRequestEntityTooLarge,
+		`["8.8.8.8", 1]`:                    http.StatusBadRequest,
+		`[""]`:                              http.StatusBadRequest,
+	} {
+		w := httptest.NewRecorder()
+		f.ServeHTTP(w, httptest.NewRequest("POST", "/batch", strings.NewReader(body)))
+		if w.Code != code {
+			t.Errorf("%s: unexpected status: %d %s", body, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestBatchRateLimit(t *testing.T) {
+	c := newTestConfig(t)
+	c.RateLimit = 0.001
+	c.RateLimitBurst = 5
+	f, err := openHandler(t, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, tc := range []struct {
+		body      string
+		code      int
+		remaining string
+	}{
+		{`["8.8.8.8", "8.8.4.4", "1.1.1.1"]`, http.StatusOK, "2"},
+		{`["8.8.8.8", "8.8.4.4", "1.1.1.1"]`, http.StatusTooManyRequests, "2"},
+		{`["8.8.8.8", "8.8.4.4"]`, http.StatusOK, "0"},
+		{`["1", "2", "3", "4", "5", "6"]`, http.StatusTooManyRequests, ""},
+	} {
+		w := httptest.NewRecorder()
+		f.ServeHTTP(w, httptest.NewRequest("POST", "/batch", strings.NewReader(tc.body)))
+		if w.Code != tc.code {
+			t.Fatalf("Request %d: unexpected status: %d %s", i, w.Code, w.Body.String())
+		}
+		if v := w.Header().Get("X-RateLimit-Remaining"); v != tc.remaining {
+			t.Errorf("Request %d: unexpected X-RateLimit-Remaining: %q", i, v)
+		}
+	}
+}
+
+func TestBatchResolve(t *testing.T) {
+	defer func(f func(context.Context, string) ([]net.IP, error), d time.Duration) {
+		lookupIP, batchResolveTimeout = f, d
+	}(lookupIP, batchResolveTimeout)
+	batchResolveTimeout = time.Second
+	var calls int32
+	lookupIP = func(ctx context.Context, host string) ([]net.IP, error) {
+		atomic.AddInt32(&calls, 1)
+		delay := 50 * time.Millisecond
+		if strings.HasPrefix(host, "blackhole") {
+			delay = time.Hour
+		}
+		select {
+		case <-time.After(delay):
+			return []net.IP{net.ParseIP("8.8.8.8")}, nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	c := newTestConfig(t)
+	c.BatchMaxSize = 100
+	f, err := openHandler(t, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Sequentially, the names would take 3.2s.
+	hosts := []string{"200.1.2.3", "blackhole.example"}
+	for i := 0; i < 64; i++ {
+		hosts = append(hosts, fmt.Sprintf("host%d.example", i))
+	}
+	body, _ := json.Marshal(hosts)
+	start := time.Now()
+	w := httptest.NewRecorder()
+	f.ServeHTTP(w, httptest.NewRequest("POST", "/batch", bytes.NewReader(body)))
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("Batch took %s", d)
+	}
+	var items []struct {
+		Query       string `json:"query"`
+		CountryCode string `json:"country_code"`
+		Error       string `json:"error"`
+	}
+	if err = json.NewDecoder(w.Body).Decode(&items); err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != len(hosts) || items[0].CountryCode != "VE" || items[1].Error != "Host lookup timed out." {
+		t.Fatalf("Unexpected items: %+v", items)
+	}
+	for _, item := range items[2:] {
+		if item.CountryCode != "US" {
+			t.Fatalf("Unexpected item: %+v", item)
+		}
+	}
+	if n := atomic.LoadInt32(&calls); n != int32(len(hosts)-1) {
+		t.Errorf("Unexpected lookups: %d", n)
+	}
+}
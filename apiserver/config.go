@@ -5,13 +5,17 @@
 package apiserver
 
 import (
+	"crypto/tls"
 	"flag"
+	"fmt"
 	"io"
 	"log"
+	"net"
 	"os"
 	"strconv"
 	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/fiorix/freegeoip"
 	"github.com/kelseyhightower/envconfig"
@@ -22,29 +26,78 @@ type Config struct {
 	FastOpen         bool          `envconfig:"TCP_FAST_OPEN"`
 	Host             string        `envconfig:"HOST"`
 	Port             int           `envconfig:"PORT"`
+	TLSPort          int           `envconfig:"TLS_PORT"`
+	TLSCertFile      string        `envconfig:"TLS_CERT"`
+	TLSKeyFile       string        `envconfig:"TLS_KEY"`
+	TLSClientCAFile  string        `envconfig:"TLS_CLIENT_CA"`
 	ReadTimeout      time.Duration `envconfig:"READ_TIMEOUT"`
 	WriteTimeout     time.Duration `envconfig:"WRITE_TIMEOUT"`
 	DB               string        `envconfig:"DB"`
+	DBPollInterval   time.Duration `envconfig:"DB_POLL_INTERVAL"`
+	DBMaxAge         time.Duration `envconfig:"DB_MAX_AGE"`
+	DBCacheFile      string        `envconfig:"DB_CACHE_FILE"`
+	ServeDB          bool          `envconfig:"SERVE_DB"`
+	Peers            string        `envconfig:"PEERS"`
+	PeerSecret       string        `envconfig:"PEER_SECRET"`
+	StaleNotReady    bool          `envconfig:"STALE_NOT_READY"`
+	StatusPrefix     string        `envconfig:"STATUS_PREFIX"`
+	Metrics          bool          `envconfig:"METRICS"`
+	MetricsAddr      string        `envconfig:"METRICS_ADDR"`
 	UseXForwardedFor bool          `envconfig:"USE_X_FORWARDED_FOR"`
+	TrustedProxies   string        `envconfig:"TRUSTED_PROXIES"`
+	RateLimit        float64       `envconfig:"RATE_LIMIT"`
+	RateLimitKey     float64       `envconfig:"RATE_LIMIT_KEY"`
+	RateLimitBurst   int           `envconfig:"RATE_LIMIT_BURST"`
+	APIKeysFile      string        `envconfig:"API_KEYS_FILE"`
+	CORSOrigins      string        `envconfig:"CORS_ORIGINS"`
+	CORSMethods      string        `envconfig:"CORS_METHODS"`
+	CORSHeaders      string        `envconfig:"CORS_HEADERS"`
+	CORSMaxAge       time.Duration `envconfig:"CORS_MAX_AGE"`
+	CSVDelimiter     string        `envconfig:"CSV_DELIMITER"`
+	BatchMaxSize     int           `envconfig:"BATCH_MAX_SIZE"`
+	DisableJSONP     bool          `envconfig:"DISABLE_JSONP"`
 	Silent           bool          `envconfig:"SILENT"`
 	LogToStdout      bool          `envconfig:"LOGTOSTDOUT"`
 	LogTimestamp     bool          `envconfig:"LOGTIMESTAMP"`
+	HistoryDir       string        `envconfig:"HISTORY_DIR"`
+	HistoryCount     int           `envconfig:"HISTORY_COUNT"`
+	HistoryMaxAge    time.Duration `envconfig:"HISTORY_MAX_AGE"`
+	CanaryProbes     string        `envconfig:"CANARY_PROBES"`
+	CanaryMaxChange  float64       `envconfig:"CANARY_MAX_CHANGE"`
+	WebhookURL       string        `envconfig:"WEBHOOK_URL"`
+	InstanceID       string        `envconfig:"INSTANCE_ID"`
+
+	// RateLimitStore keeps the rate limits of clients, in memory if
+	// nil. Set it to share limits between instances.
+	RateLimitStore RateLimitStore `ignored:"true"`
 }
 
 func (c *Config) ServerAddr() string {
 	return strings.Join([]string{c.Host, strconv.Itoa(c.Port)}, ":")
 }
 
+// TLSServerAddr returns the address of the HTTPS server.
+func (c *Config) TLSServerAddr() string {
+	return strings.Join([]string{c.Host, strconv.Itoa(c.TLSPort)}, ":")
+}
+
 // NewConfig creates and initializes a new Config with default values.
 func NewConfig() *Config {
 	return &Config{
 		FastOpen:     false,
 		Host:         "",
 		Port:         8080,
+		TLSPort:      8443,
 		ReadTimeout:  30 * time.Second,
 		WriteTimeout: 15 * time.Second,
 		DB:           freegeoip.MaxMindDBURL,
+		CORSMethods:  "GET,POST",
+		CORSHeaders:  "Accept,Accept-Language,Content-Type,X-API-Key",
+		CORSMaxAge:   10 * time.Minute,
+		CSVDelimiter: ",",
+		BatchMaxSize: 1000,
 		LogTimestamp: true,
+		HistoryCount: 12,
 	}
 }
 
@@ -54,13 +107,163 @@ func (c *Config) AddFlags(fs *flag.FlagSet) {
 	fs.BoolVar(&c.FastOpen, "tcp-fast-open", c.FastOpen, "Enable TCP fast open")
 	fs.StringVar(&c.Host, "host", c.Host, "Hostname of server. Default empty")
 	fs.IntVar(&c.Port, "port", c.Port, "Port to listen to. Default 8080")
+	fs.IntVar(&c.TLSPort, "tls-port", c.TLSPort, "Port of the HTTPS server, enabled by -cert and -key. Default 8443")
+	fs.StringVar(&c.TLSCertFile, "cert", c.TLSCertFile, "X.509 certificate file of the HTTPS server, reloaded when it changes. Default HTTP only")
+	fs.StringVar(&c.TLSKeyFile, "key", c.TLSKeyFile, "X.509 key file of the HTTPS server")
+	fs.StringVar(&c.TLSClientCAFile, "client-ca", c.TLSClientCAFile, "CA certificates file to require and verify client certificates of HTTPS requests. Default no client certificates")
 	fs.DurationVar(&c.ReadTimeout, "read-timeout", c.ReadTimeout, "Read timeout for HTTP and HTTPS client conns")
 	fs.DurationVar(&c.WriteTimeout, "write-timeout", c.WriteTimeout, "Write timeout for HTTP and HTTPS client conns")
 	fs.StringVar(&c.DB, "db", c.DB, "IP database file or URL")
+	fs.DurationVar(&c.DBPollInterval, "db-poll-interval", c.DBPollInterval, "Poll the database file for changes at this interval instead of using fsnotify (e.g. on NFS). Default disabled")
+	fs.DurationVar(&c.DBMaxAge, "db-max-age", c.DBMaxAge, "Report the database as stale when it is older than this, e.g. 2160h. Default disabled")
+	fs.StringVar(&c.DBCacheFile, "db-cache-file", c.DBCacheFile, "Local copy of the database when -db is a URL. Default ./db.gz")
+	fs.BoolVar(&c.ServeDB, "serve-db", c.ServeDB, "Serve the current database file to peers at /admin/db")
+	fs.StringVar(&c.Peers, "peers", c.Peers, "Comma separated URLs of the /admin/db endpoint of other instances, to download the database from before the -db URL")
+	fs.StringVar(&c.PeerSecret, "peer-secret", c.PeerSecret, "Secret shared by the instances of -serve-db and -peers, required by -serve-db")
+	fs.BoolVar(&c.StaleNotReady, "stale-not-ready", c.StaleNotReady, "Fail the /readyz check while the database is stale, see -db-max-age")
+	fs.StringVar(&c.StatusPrefix, "status-prefix", c.StatusPrefix, "Path prefix of the /healthz, /readyz, /status and /metrics endpoints, e.g. /internal. Default empty")
+	fs.BoolVar(&c.Metrics, "metrics", c.Metrics, "Serve Prometheus metrics at /metrics")
+	fs.StringVar(&c.MetricsAddr, "metrics-addr", c.MetricsAddr, "Serve /metrics on this address instead of the main listener, e.g. localhost:8888. Implies -metrics")
 	fs.BoolVar(&c.UseXForwardedFor, "use-x-forwarded-for", c.UseXForwardedFor, "Use the X-Forwarded-For header when available (e.g. behind proxy)")
+	fs.StringVar(&c.TrustedProxies, "trusted-proxies", c.TrustedProxies, "Comma separated addresses or networks of the proxies whose X-Forwarded-For entries identify rate limited clients, e.g. 10.0.0.0/8. Default limit by connection address")
+	fs.Float64Var(&c.RateLimit, "rate-limit", c.RateLimit, "Requests per second allowed per client IP, e.g. 10. Default unlimited")
+	fs.Float64Var(&c.RateLimitKey, "rate-limit-key", c.RateLimitKey, "Requests per second allowed per API key of -api-keys-file, instead of per client IP. Default limit by IP")
+	fs.IntVar(&c.RateLimitBurst, "rate-limit-burst", c.RateLimitBurst, "Requests a client can make at once before being limited to the rate. Default the rate")
+	fs.StringVar(&c.APIKeysFile, "api-keys-file", c.APIKeysFile, "JSON file of the API keys required to use the API and their policies, reloaded when it changes. Default no authentication")
+	fs.StringVar(&c.CORSOrigins, "cors-origins", c.CORSOrigins, "Comma separated origins allowed to make cross-origin requests, * for any or with a wildcard, e.g. https://*.example.com. Default disabled")
+	fs.StringVar(&c.CORSMethods, "cors-methods", c.CORSMethods, "Comma separated methods allowed in cross-origin requests")
+	fs.StringVar(&c.CORSHeaders, "cors-headers", c.CORSHeaders, "Comma separated request headers allowed in cross-origin requests, * for any")
+	fs.DurationVar(&c.CORSMaxAge, "cors-max-age", c.CORSMaxAge, "How long browsers can cache the result of preflight requests, 0 to not send it")
+	fs.StringVar(&c.CSVDelimiter, "csv-delimiter", c.CSVDelimiter, "Field delimiter of the /csv/ output, a single character or \\t for tab")
+	fs.IntVar(&c.BatchMaxSize, "batch-max-size", c.BatchMaxSize, "Maximum number of hosts in a /batch request, 0 disables /batch")
+	fs.BoolVar(&c.DisableJSONP, "disable-jsonp", c.DisableJSONP, "Reject /json/ requests with a callback parameter instead of answering with JSONP")
 	fs.BoolVar(&c.Silent, "silent", c.Silent, "Disable HTTP and HTTPS log request details")
 	fs.BoolVar(&c.LogToStdout, "logtostdout", c.LogToStdout, "Log to stdout instead of stderr")
 	fs.BoolVar(&c.LogTimestamp, "logtimestamp", c.LogTimestamp, "Prefix non-access logs with timestamp")
+	fs.StringVar(&c.HistoryDir, "history-dir", c.HistoryDir, "Directory to keep previous database builds for lookups with the at parameter. Default disabled")
+	fs.IntVar(&c.HistoryCount, "history-count", c.HistoryCount, "Maximum number of previous database builds to keep, 0 for unlimited")
+	fs.DurationVar(&c.HistoryMaxAge, "history-max-age", c.HistoryMaxAge, "How long to keep previous database builds after they are replaced, 0 for unlimited")
+	fs.StringVar(&c.CanaryProbes, "canary-probes", c.CanaryProbes, "Comma separated ip=country probes new database builds must pass, e.g. 8.8.8.8=US. Default disabled")
+	fs.Float64Var(&c.CanaryMaxChange, "canary-max-change", c.CanaryMaxChange, "Maximum ratio of sampled addresses whose country may change in a new database build, e.g. 0.05. Default disabled")
+	fs.StringVar(&c.WebhookURL, "webhook-url", c.WebhookURL, "URL to POST database events to as JSON. Default disabled")
+	fs.StringVar(&c.InstanceID, "instance-id", c.InstanceID, "Name of this instance in database events. Default hostname")
+}
+
+func (c *Config) dbOptions() ([]freegeoip.Option, error) {
+	var opts []freegeoip.Option
+	if c.DBPollInterval > 0 {
+		opts = append(opts, freegeoip.WithPolling(c.DBPollInterval))
+	}
+	if c.DBCacheFile != "" {
+		opts = append(opts, freegeoip.WithCacheFile(c.DBCacheFile))
+	}
+	if peers := splitList(c.Peers); len(peers) > 0 {
+		opts = append(opts, freegeoip.WithPeers(peers...))
+	}
+	if c.PeerSecret != "" {
+		opts = append(opts, freegeoip.WithPeerSecret(c.PeerSecret))
+	}
+	if c.DBMaxAge > 0 {
+		opts = append(opts, freegeoip.WithMaxAge(c.DBMaxAge))
+	}
+	if c.HistoryDir != "" {
+		opts = append(opts, freegeoip.WithHistory(c.HistoryDir, c.HistoryCount, c.HistoryMaxAge))
+	}
+	if c.CanaryProbes != "" || c.CanaryMaxChange > 0 {
+		probes, err := freegeoip.ParseProbes(c.CanaryProbes)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, freegeoip.WithCanary(probes, c.CanaryMaxChange))
+	}
+	return opts, nil
+}
+
+// tlsConfig returns the configuration of the HTTPS server and its
+// files, nil if HTTPS is disabled.
+func (c *Config) tlsConfig() (*tls.Config, *tlsFiles, error) {
+	if c.TLSCertFile == "" && c.TLSKeyFile == "" {
+		if c.TLSClientCAFile != "" {
+			return nil, nil, fmt.Errorf("client CA file requires a certificate and key")
+		}
+		return nil, nil, nil
+	}
+	if c.TLSCertFile == "" || c.TLSKeyFile == "" {
+		return nil, nil, fmt.Errorf("HTTPS requires both a certificate and key file")
+	}
+	return newTLSFiles(c.TLSCertFile, c.TLSKeyFile, c.TLSClientCAFile)
+}
+
+func (c *Config) csvComma() (rune, error) {
+	if c.CSVDelimiter == `\t` || c.CSVDelimiter == "tab" {
+		return '\t', nil
+	}
+	r := []rune(c.CSVDelimiter)
+	if len(r) != 1 || r[0] == '"' || r[0] == '\r' || r[0] == '\n' || r[0] == utf8.RuneError {
+		return 0, fmt.Errorf("invalid CSV delimiter: %q", c.CSVDelimiter)
+	}
+	return r[0], nil
+}
+
+func (c *Config) statusPrefix() (string, error) {
+	prefix := strings.TrimSuffix(c.StatusPrefix, "/")
+	if prefix != "" && (prefix[0] != '/' || strings.ContainsAny(prefix, ":*")) {
+		return "", fmt.Errorf("invalid status prefix: %q", c.StatusPrefix)
+	}
+	return prefix, nil
+}
+
+// trustedProxies returns the networks of -trusted-proxies, where
+// addresses are single host networks.
+func (c *Config) trustedProxies() ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, v := range splitList(c.TrustedProxies) {
+		if ip := net.ParseIP(v); ip != nil {
+			bits := 8 * len(ip)
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy: %q", v)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// splitList splits a comma separated list, ignoring empty items.
+func splitList(s string) []string {
+	var list []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+func (c *Config) eventSinks() ([]eventSink, error) {
+	var sinks []eventSink
+	if c.WebhookURL != "" {
+		w, err := newWebhook(c.WebhookURL)
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, w)
+	}
+	return sinks, nil
+}
+
+func (c *Config) instanceID() string {
+	if c.InstanceID != "" {
+		return c.InstanceID
+	}
+	name, _ := os.Hostname()
+	return name
 }
 
 func (c *Config) logWriter() io.Writer {
@@ -0,0 +1,149 @@
+// Copyright 2009 The freegeoip authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package apiserver
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Response headers that browsers expose to scripts on other origins,
+// besides the safelisted ones such as Content-Language.
+const corsExposedHeaders = "X-RateLimit-Limit, X-RateLimit-Remaining, X-RateLimit-Reset, Retry-After"
+
+// cors handles cross-origin requests of browsers.
+type cors struct {
+	origins []string        // Lower case, at most one * each.
+	methods map[string]bool // Upper case.
+	headers map[string]bool // Canonical, any if nil.
+	allow   string          // Access-Control-Allow-Methods.
+	maxAge  string          // Access-Control-Max-Age, none if empty.
+}
+
+// newCORS returns the cors of the configuration, nil if no origin is
+// allowed.
+func newCORS(c *Config) (*cors, error) {
+	origins := splitList(c.CORSOrigins)
+	if len(origins) == 0 {
+		return nil, nil
+	}
+	h := &cors{methods: make(map[string]bool)}
+	for _, o := range origins {
+		if strings.Count(o, "*") > 1 {
+			return nil, fmt.Errorf("invalid CORS origin: %q", o)
+		}
+		h.origins = append(h.origins, strings.ToLower(o))
+	}
+	methods := splitList(c.CORSMethods)
+	for i, m := range methods {
+		methods[i] = strings.ToUpper(m)
+		h.methods[methods[i]] = true
+	}
+	h.allow = strings.Join(methods, ", ")
+	for _, name := range splitList(c.CORSHeaders) {
+		if name == "*" {
+			h.headers = nil
+			break
+		}
+		if h.headers == nil {
+			h.headers = make(map[string]bool)
+		}
+		h.headers[http.CanonicalHeaderKey(name)] = true
+	}
+	if c.CORSMaxAge < 0 {
+		return nil, fmt.Errorf("invalid CORS max age: %s", c.CORSMaxAge)
+	}
+	if c.CORSMaxAge > 0 {
+		h.maxAge = strconv.Itoa(int(c.CORSMaxAge / time.Second))
+	}
+	return h, nil
+}
+
+// allowOrigin returns the Access-Control-Allow-Origin of an origin, or
+// an empty string if it is not allowed.
+func (h *cors) allowOrigin(origin string) string {
+	origin = strings.ToLower(origin)
+	for _, o := range h.origins {
+		if o == "*" {
+			return "*"
+		}
+		if i := strings.IndexByte(o, '*'); i >= 0 {
+			if len(origin) > len(o)-1 && strings.HasPrefix(origin, o[:i]) && strings.HasSuffix(origin, o[i+1:]) {
+				return origin
+			}
+		} else if o == origin {
+			return origin
+		}
+	}
+	return ""
+}
+
+// allowHeaders reports whether all the headers of an
+// Access-Control-Request-Headers are allowed.
+func (h *cors) allowHeaders(requested string) bool {
+	if h.headers == nil {
+		return true
+	}
+	for _, name := range splitList(requested) {
+		if !h.headers[http.CanonicalHeaderKey(name)] {
+			return false
+		}
+	}
+	return true
+}
+
+// handler is a middleware that adds the CORS headers of allowed
+// origins to responses, and answers their preflight requests without
+// calling next. Preflight requests of origins, methods or headers that
+// are not allowed get no CORS headers, so that browsers fail them.
+func (h *cors) handler(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		method := r.Header.Get("Access-Control-Request-Method")
+		preflight := r.Method == http.MethodOptions && method != ""
+		hdr := w.Header()
+		if preflight {
+			hdr.Add("Vary", "Origin, Access-Control-Request-Method, Access-Control-Request-Headers")
+		} else {
+			hdr.Add("Vary", "Origin")
+		}
+		allow := ""
+		if origin != "" {
+			allow = h.allowOrigin(origin)
+		}
+		if !preflight {
+			if allow != "" {
+				hdr.Set("Access-Control-Allow-Origin", allow)
+				hdr.Set("Access-Control-Expose-Headers", corsExposedHeaders)
+			}
+			next(w, r)
+			return
+		}
+		requested := r.Header.Get("Access-Control-Request-Headers")
+		if allow != "" && h.methods[method] && h.allowHeaders(requested) {
+			hdr.Set("Access-Control-Allow-Origin", allow)
+			hdr.Set("Access-Control-Allow-Methods", h.allow)
+			if requested != "" {
+				hdr.Set("Access-Control-Allow-Headers", requested)
+			}
+			if h.maxAge != "" {
+				hdr.Set("Access-Control-Max-Age", h.maxAge)
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// options answers the OPTIONS requests of a route that are not
+// preflight requests, as httprouter does when CORS is disabled.
+func options(method string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Allow", method+", OPTIONS")
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,137 @@
+// Copyright 2009 The freegeoip authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package apiserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+func TestCORS(t *testing.T) {
+	c := newTestConfig(t)
+	c.CORSOrigins = "https://app.example.org, https://*.example.com"
+	f, err := openHandler(t, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		origin string
+		allow  string
+	}{
+		{"https://app.example.org", "https://app.example.org"},
+		{"https://www.example.com", "https://www.example.com"},
+		{"HTTPS://WWW.EXAMPLE.COM", "https://www.example.com"},
+		{"https://example.com", ""},
+		{"https://example.com.evil.org", ""},
+		{"http://www.example.com", ""},
+		{"", ""},
+	} {
+		r := httptest.NewRequest("GET", "/json/8.8.8.8", nil)
+		if tc.origin != "" {
+			r.Header.Set("Origin", tc.origin)
+		}
+		w := httptest.NewRecorder()
+		f.ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Unexpected response: %d %s", w.Code, w.Body.String())
+		}
+		if v := w.Header().Get("Access-Control-Allow-Origin"); v != tc.allow {
+			t.Errorf("Origin %q: unexpected Access-Control-Allow-Origin: %q", tc.origin, v)
+		}
+		if v := w.Header().Get("Vary"); v != "Origin" {
+			t.Errorf("Origin %q: unexpected Vary: %q", tc.origin, v)
+		}
+	}
+}
+
+func TestCORSPreflight(t *testing.T) {
+	c := newTestConfig(t)
+	c.CORSOrigins = "*"
+	c.APIKeysFile = filepath.Join(t.TempDir(), "keys.json")
+	writeAPIKeys(t, c.APIKeysFile, `[{"key": "k1"}]`)
+	f, err := openHandler(t, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		path, method, headers string
+		allowed               bool
+	}{
+		{"/json/8.8.8.8", "GET", "", true},
+		{"/json/8.8.8.8", "GET", "x-api-key, accept-language", true},
+		{"/batch", "POST", "Content-Type", true},
+		{"/json/8.8.8.8", "DELETE", "", false},
+		{"/json/8.8.8.8", "GET", "X-Custom", false},
+	} {
+		r := httptest.NewRequest("OPTIONS", tc.path, nil)
+		r.Header.Set("Origin", "https://app.example.org")
+		r.Header.Set("Access-Control-Request-Method", tc.method)
+		if tc.headers != "" {
+			r.Header.Set("Access-Control-Request-Headers", tc.headers)
+		}
+		w := httptest.NewRecorder()
+		f.ServeHTTP(w, r)
+		if w.Code != http.StatusNoContent {
+			t.Fatalf("%+v: unexpected response: %d %s", tc, w.Code, w.Body.String())
+		}
+		hdr := w.Header()
+		if !tc.allowed {
+			if v := hdr.Get("Access-Control-Allow-Origin"); v != "" {
+				t.Errorf("%+v: unexpected Access-Control-Allow-Origin: %q", tc, v)
+			}
+			continue
+		}
+		for k, v := range map[string]string{
+			"Access-Control-Allow-Origin":  "*",
+			"Access-Control-Allow-Methods": "GET, POST",
+			"Access-Control-Allow-Headers": tc.headers,
+			"Access-Control-Max-Age":       "600",
+		} {
+			if hdr.Get(k) != v {
+				t.Errorf("%+v: unexpected %s: %q", tc, k, hdr.Get(k))
+			}
+		}
+	}
+
+	// Other OPTIONS requests are not answered by the middleware.
+	w := httptest.NewRecorder()
+	f.ServeHTTP(w, httptest.NewRequest("OPTIONS", "/json/8.8.8.8", nil))
+	if w.Code != http.StatusNoContent || w.Header().Get("Allow") != "GET, OPTIONS" {
+		t.Errorf("Unexpected response: %d %v", w.Code, w.Header())
+	}
+
+	// Actual requests still need an API key.
+	r := httptest.NewRequest("GET", "/json/8.8.8.8", nil)
+	r.Header.Set("Origin", "https://app.example.org")
+	w = httptest.NewRecorder()
+	f.ServeHTTP(w, r)
+	if w.Code != http.StatusUnauthorized || w.Header().Get("Access-Control-Allow-Origin") != "*" {
+		t.Errorf("Unexpected response: %d %v", w.Code, w.Header())
+	}
+}
+
+func TestCORSDisabled(t *testing.T) {
+	f, err := openHandler(t, newTestConfig(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("GET", "/json/8.8.8.8", nil)
+	r.Header.Set("Origin", "https://app.example.org")
+	w := httptest.NewRecorder()
+	f.ServeHTTP(w, r)
+	if v := w.Header().Get("Access-Control-Allow-Origin"); v != "" {
+		t.Errorf("Unexpected Access-Control-Allow-Origin: %q", v)
+	}
+}
+
+func TestCORSInvalid(t *testing.T) {
+	c := newTestConfig(t)
+	c.CORSOrigins = "https://*.*.example.com"
+	if _, err := openHandler(t, c); err == nil {
+		t.Error("Unexpected handler with an invalid origin")
+	}
+}
@@ -0,0 +1,88 @@
+// Copyright 2009 The freegeoip authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package apiserver
+
+import (
+	"log"
+	"time"
+
+	"github.com/fiorix/freegeoip"
+)
+
+// Types of database events.
+const (
+	eventLoaded       = "loaded"        // A database build was loaded.
+	eventUpdateFailed = "update_failed" // Downloading or loading failed.
+	eventRolledBack   = "rolled_back"   // A build failed validation.
+	eventStale        = "stale"         // The database is too old.
+)
+
+// dbEvent is a database lifecycle event, as sent to event sinks.
+type dbEvent struct {
+	Type      string    `json:"type"`
+	Instance  string    `json:"instance"`
+	Time      time.Time `json:"time"`
+	File      string    `json:"file,omitempty"`
+	Checksum  string    `json:"checksum,omitempty"`   // Of the running database.
+	BuildDate string    `json:"build_date,omitempty"` // Of the running database.
+	Error     string    `json:"error,omitempty"`
+}
+
+// eventSink receives database events. Sends must not block.
+type eventSink interface {
+	send(e *dbEvent)
+	close()
+}
+
+// watchEvents logs database events and sends them to sinks until the
+// database is closed.
+func watchEvents(db *freegeoip.DB, instance string, sinks ...eventSink) {
+	defer func() {
+		for _, s := range sinks {
+			s.close()
+		}
+	}()
+	for {
+		e := &dbEvent{Instance: instance}
+		select {
+		case file, ok := <-db.NotifyOpen():
+			if !ok {
+				return
+			}
+			log.Println("database loaded:", file)
+			e.Type, e.File = eventLoaded, file
+		case err, ok := <-db.NotifyError():
+			if !ok {
+				return
+			}
+			log.Println("database error:", err)
+			switch err.(type) {
+			case *freegeoip.ValidationError:
+				e.Type = eventRolledBack
+			case *freegeoip.StaleError:
+				e.Type = eventStale
+			default:
+				e.Type = eventUpdateFailed
+			}
+			e.Error = err.Error()
+		case msg, ok := <-db.NotifyInfo():
+			if !ok {
+				return
+			}
+			log.Println("database info:", msg)
+			continue
+		case <-db.NotifyClose():
+			return
+		}
+		e.Time = time.Now().UTC()
+		e.Checksum = db.Checksum()
+		if date := db.BuildDate(); !date.IsZero() {
+			e.BuildDate = date.Format(time.RFC3339)
+		}
+		for _, s := range sinks {
+			s.send(e)
+		}
+	}
+}
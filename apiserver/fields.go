@@ -0,0 +1,213 @@
+// Copyright 2009 The freegeoip authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package apiserver
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// responseField is a field of the response that can be selected with
+// the fields parameter.
+type responseField struct {
+	name    string // In JSON and CSV.
+	xmlName string
+
+	// Structured fields are only in extended responses, or when
+	// selected, and have no CSV representation.
+	structured bool
+
+	value func(rr *responseRecord) interface{}
+}
+
+// responseFields are the fields of the response, in output order.
+var responseFields = []*responseField{
+	{"ip", "IP", false, func(rr *responseRecord) interface{} { return rr.IP }},
+	{"country_code", "CountryCode", false, func(rr *responseRecord) interface{} { return rr.CountryCode }},
+	{"country_name", "CountryName", false, func(rr *responseRecord) interface{} { return rr.CountryName }},
+	{"region_code", "RegionCode", false, func(rr *responseRecord) interface{} { return rr.RegionCode }},
+	{"region_name", "RegionName", false, func(rr *responseRecord) interface{} { return rr.RegionName }},
+	{"city", "City", false, func(rr *responseRecord) interface{} { return rr.City }},
+	{"zip_code", "ZipCode", false, func(rr *responseRecord) interface{} { return rr.ZipCode }},
+	{"time_zone", "TimeZone", false, func(rr *responseRecord) interface{} { return rr.TimeZone }},
+	{"latitude", "Latitude", false, func(rr *responseRecord) interface{} { return rr.Latitude }},
+	{"longitude", "Longitude", false, func(rr *responseRecord) interface{} { return rr.Longitude }},
+	{"metro_code", "MetroCode", false, func(rr *responseRecord) interface{} { return rr.MetroCode }},
+	{"continent", "Continent", false, func(rr *responseRecord) interface{} { return rr.Continent }},
+	{"reserved", "Reserved", false, func(rr *responseRecord) interface{} { return rr.Reserved }},
+	{"scope", "Scope", false, func(rr *responseRecord) interface{} { return rr.Scope }},
+	{"subdivisions", "Subdivisions", true, func(rr *responseRecord) interface{} { return rr.Subdivisions }},
+	{"names", "Names", true, func(rr *responseRecord) interface{} { return rr.Names }},
+}
+
+var (
+	// defaultFields are the fields of JSON responses without the fields
+	// and extended parameters.
+	defaultFields = responseFields[:14]
+
+	// csvFields are the columns of CSV responses without the fields
+	// and extended parameters, up to metro_code.
+	csvFields = responseFields[:11]
+
+	responseFieldsByName = make(map[string]*responseField)
+)
+
+func init() {
+	for _, f := range responseFields {
+		responseFieldsByName[f.name] = f
+	}
+}
+
+// parseFields returns the fields selected by the fields parameter of a
+// request, in the given order, or all fields if the extended parameter
+// is set. It returns nil for the default response.
+func parseFields(r *http.Request) ([]*responseField, error) {
+	if v := r.FormValue("fields"); v != "" {
+		var fields []*responseField
+		for _, name := range strings.Split(v, ",") {
+			f, ok := responseFieldsByName[strings.TrimSpace(name)]
+			if !ok {
+				return nil, fmt.Errorf("Unknown field %q, valid fields are: %s.",
+					strings.TrimSpace(name), strings.Join(fieldNames(responseFields), ", "))
+			}
+			fields = append(fields, f)
+		}
+		return fields, nil
+	}
+	if extended, _ := strconv.ParseBool(r.FormValue("extended")); extended {
+		return responseFields, nil
+	}
+	return nil, nil
+}
+
+func fieldNames(fields []*responseField) []string {
+	names := make([]string, len(fields))
+	for i, f := range fields {
+		names[i] = f.name
+	}
+	return names
+}
+
+// shapedRecord is a responseRecord with the selected fields only, in
+// their order.
+type shapedRecord struct {
+	rr     *responseRecord
+	fields []*responseField
+}
+
+// shaped returns the record to encode as JSON or XML.
+func (rr *responseRecord) shaped() interface{} {
+	if rr.fields == nil {
+		return rr
+	}
+	return shapedRecord{rr, rr.fields}
+}
+
+func (s shapedRecord) MarshalJSON() ([]byte, error) {
+	b, err := s.appendJSON([]byte{'{'})
+	if err != nil {
+		return nil, err
+	}
+	return append(b, '}'), nil
+}
+
+// appendJSON appends the fields of the record as members of the JSON
+// object being written to b.
+func (s shapedRecord) appendJSON(b []byte) ([]byte, error) {
+	for _, f := range s.fields {
+		if b[len(b)-1] != '{' {
+			b = append(b, ',')
+		}
+		b = strconv.AppendQuote(b, f.name)
+		b = append(b, ':')
+		v, err := json.Marshal(f.value(s.rr))
+		if err != nil {
+			return nil, err
+		}
+		b = append(b, v...)
+	}
+	return b, nil
+}
+
+func (s shapedRecord) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	start.Name.Local = "Response"
+	if err := e.EncodeToken(start); err != nil {
+		return err
+	}
+	for _, f := range s.fields {
+		err := e.EncodeElement(f.value(s.rr), xml.StartElement{Name: xml.Name{Local: f.xmlName}})
+		if err != nil {
+			return err
+		}
+	}
+	return e.EncodeToken(start.End())
+}
+
+// csvValue formats the value of a scalar field for CSV.
+func csvValue(v interface{}) string {
+	switch v := v.(type) {
+	case float64:
+		return strconv.FormatFloat(v, 'f', 4, 64)
+	case uint:
+		return strconv.FormatUint(uint64(v), 10)
+	case bool:
+		return strconv.FormatBool(v)
+	}
+	return fmt.Sprint(v)
+}
+
+// subdivision is a region of a country in extended responses, largest
+// first.
+type subdivision struct {
+	Code  string `json:"code" xml:"Code"`
+	Name  string `json:"name" xml:"Name"`
+	Names names  `json:"names,omitempty" xml:"Names,omitempty"`
+}
+
+type subdivisions []subdivision
+
+func (s subdivisions) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	return e.EncodeElement(struct {
+		Items []subdivision `xml:"Subdivision"`
+	}{s}, start)
+}
+
+// names are the translations of a name by language code.
+type names map[string]string
+
+// MarshalXML encodes the names as <Name lang="..."> elements, sorted by
+// language.
+func (n names) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	langs := make([]string, 0, len(n))
+	for lang := range n {
+		langs = append(langs, lang)
+	}
+	sort.Strings(langs)
+	if err := e.EncodeToken(start); err != nil {
+		return err
+	}
+	for _, lang := range langs {
+		el := xml.StartElement{
+			Name: xml.Name{Local: "Name"},
+			Attr: []xml.Attr{{Name: xml.Name{Local: "lang"}, Value: lang}},
+		}
+		if err := e.EncodeElement(n[lang], el); err != nil {
+			return err
+		}
+	}
+	return e.EncodeToken(start.End())
+}
+
+// recordNames are all the translations of the names of a record.
+type recordNames struct {
+	Continent names `json:"continent,omitempty" xml:"Continent,omitempty"`
+	Country   names `json:"country,omitempty" xml:"Country,omitempty"`
+	City      names `json:"city,omitempty" xml:"City,omitempty"`
+}
@@ -0,0 +1,119 @@
+// Copyright 2009 The freegeoip authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package apiserver
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestFields(t *testing.T) {
+	f, err := newTestHandler(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		path string
+		want string
+	}{
+		{"/json/8.8.8.8?fields=country_code,city,latitude",
+			`{"country_code":"US","city":"Mountain View","latitude":37.386}` + "\n"},
+		{"/json/8.8.8.8?fields=+scope+,ip",
+			`{"scope":"global","ip":"8.8.8.8"}` + "\n"},
+		{"/xml/200.1.2.3?fields=city,scope",
+			"<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n<Response>\n\t<City>Caracas</City>\n\t<Scope>global</Scope>\n</Response>\n"},
+		{"/csv/8.8.8.8?fields=city,reserved&header=1",
+			"city,reserved\r\nMountain View,false\r\n"},
+		{"/csv/8.8.8.8?extended=1",
+			"8.8.8.8,US,United States,CA,California,Mountain View,94035,America/Los_Angeles,37.3860,-122.0838,807,North America,false,global\r\n"},
+	} {
+		w := httptest.NewRecorder()
+		f.ServeHTTP(w, httptest.NewRequest("GET", tc.path, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: unexpected response: %d %s", tc.path, w.Code, w.Body.String())
+		}
+		if w.Body.String() != tc.want {
+			t.Errorf("%s: unexpected response:\nhave %q\nwant %q", tc.path, w.Body.String(), tc.want)
+		}
+	}
+}
+
+func TestFieldsExtended(t *testing.T) {
+	f, err := newTestHandler(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	f.ServeHTTP(w, httptest.NewRequest("GET", "/json/8.8.8.8?extended=1", nil))
+	var m struct {
+		Scope        string `json:"scope"`
+		Subdivisions []struct {
+			Code  string            `json:"code"`
+			Name  string            `json:"name"`
+			Names map[string]string `json:"names"`
+		} `json:"subdivisions"`
+		Names struct {
+			Country map[string]string `json:"country"`
+		} `json:"names"`
+	}
+	if err = json.NewDecoder(w.Body).Decode(&m); err != nil {
+		t.Fatal(err)
+	}
+	if m.Scope != "global" || len(m.Subdivisions) != 1 ||
+		m.Subdivisions[0].Code != "CA" || m.Subdivisions[0].Name != "California" ||
+		m.Subdivisions[0].Names["fr"] != "Californie" ||
+		m.Names.Country["de"] != "USA" || m.Names.Country["en"] != "United States" {
+		t.Fatalf("Unexpected extended response: %+v", m)
+	}
+
+	w = httptest.NewRecorder()
+	f.ServeHTTP(w, httptest.NewRequest("GET", "/xml/8.8.8.8?extended=1", nil))
+	checkGolden(t, "extended.xml", w.Body.Bytes())
+}
+
+func TestFieldsInvalid(t *testing.T) {
+	f, err := newTestHandler(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{
+		"/json/8.8.8.8?fields=city,foo",
+		"/csv/8.8.8.8?fields=city,names",
+	} {
+		w := httptest.NewRecorder()
+		f.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: unexpected status: %d", path, w.Code)
+		}
+	}
+	w := httptest.NewRecorder()
+	f.ServeHTTP(w, httptest.NewRequest("GET", "/json/8.8.8.8?fields=foo", nil))
+	if body := w.Body.String(); !strings.Contains(body, `"foo"`) || !strings.Contains(body, "country_code") {
+		t.Errorf("Unexpected error: %q", body)
+	}
+}
+
+func TestBatchFields(t *testing.T) {
+	f, err := newTestHandler(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := strings.NewReader(`["8.8.8.8", "not a host"]`)
+	w := httptest.NewRecorder()
+	f.ServeHTTP(w, httptest.NewRequest("POST", "/batch?fields=city", body))
+	want := `[{"query":"8.8.8.8","city":"Mountain View"},{"query":"not a host","error":"Host not found."}]` + "\n"
+	if w.Body.String() != want {
+		t.Errorf("Unexpected response:\nhave %q\nwant %q", w.Body.String(), want)
+	}
+
+	w = httptest.NewRecorder()
+	f.ServeHTTP(w, httptest.NewRequest("POST", "/batch?fields=foo", strings.NewReader(`["8.8.8.8"]`)))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Unexpected status for an unknown field: %d", w.Code)
+	}
+}
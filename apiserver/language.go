@@ -0,0 +1,99 @@
+// Copyright 2009 The freegeoip authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package apiserver
+
+import (
+	"strings"
+	"sync"
+
+	"golang.org/x/text/language"
+)
+
+// Maximum number of Accept-Language values cached by a languageMatcher.
+// The cache is emptied when full, which only happens with unusual
+// clients.
+var languageCacheSize = 1024
+
+// languageMatcher picks the language of the names in responses among
+// the languages of a database.
+type languageMatcher struct {
+	key     string   // Languages of the database, comma separated.
+	langs   []string // Language codes as in the database, English first.
+	matcher language.Matcher
+
+	mu    sync.RWMutex
+	cache map[string]string // Matched language by Accept-Language value.
+	stats *cacheStats       // Hits and misses of the cache, if not nil.
+}
+
+func newLanguageMatcher(dbLangs []string) *languageMatcher {
+	// supported languages -- i.e. languages available in the DB
+	langs := []string{"en"}
+	tags := []language.Tag{language.English}
+	for _, name := range dbLangs {
+		langs = append(langs, name)
+		tags = append(tags, language.Raw.Make(name))
+	}
+	return &languageMatcher{
+		key:     strings.Join(dbLangs, ","),
+		langs:   langs,
+		matcher: language.NewMatcher(tags),
+		cache:   make(map[string]string),
+	}
+}
+
+// match returns the language that best matches an Accept-Language
+// value, or English.
+func (m *languageMatcher) match(header string) string {
+	m.mu.RLock()
+	lang, ok := m.cache[header]
+	m.mu.RUnlock()
+	m.stats.add(ok)
+	if ok {
+		return lang
+	}
+	t, _, _ := language.ParseAcceptLanguage(header)
+	// match most acceptable language, by its index in the supported
+	// ones so regional names such as pt-BR are kept
+	_, index, _ := m.matcher.Match(t...)
+	lang = m.langs[index]
+	m.mu.Lock()
+	if len(m.cache) >= languageCacheSize {
+		m.cache = make(map[string]string)
+	}
+	m.cache[header] = lang
+	m.mu.Unlock()
+	return lang
+}
+
+// languageGeneration is the language matcher of a database generation,
+// identified by its checksum.
+type languageGeneration struct {
+	checksum string
+	matcher  *languageMatcher
+}
+
+// languageMatcher returns the language matcher of the current database.
+// Matchers are built when the database is reloaded with different
+// languages, and kept along with their cache otherwise.
+func (f *apiHandler) languageMatcher() *languageMatcher {
+	checksum := f.db.Checksum()
+	gen, _ := f.languages.Load().(*languageGeneration)
+	if gen != nil && gen.checksum == checksum {
+		return gen.matcher
+	}
+	langs := f.db.Languages()
+	var m *languageMatcher
+	if gen != nil && gen.matcher.key == strings.Join(langs, ",") {
+		m = gen.matcher
+	} else {
+		m = newLanguageMatcher(langs)
+		if f.metrics != nil {
+			m.stats = &f.metrics.cache
+		}
+	}
+	f.languages.Store(&languageGeneration{checksum, m})
+	return m
+}
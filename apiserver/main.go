@@ -34,21 +34,73 @@ func Run() {
 	if !c.LogTimestamp {
 		log.SetFlags(0)
 	}
-	f, err := NewHandler(c)
+	f, m, err := newHandler(c)
 	if err != nil {
 		log.Fatal(err)
 	}
+	if c.MetricsAddr != "" {
+		go runMetricsServer(c, m)
+	}
 	runServer(c, f)
 }
 
+// runServer serves HTTP and, when configured, HTTPS concurrently.
 func runServer(c *Config, f http.Handler) {
-	log.Println("freegeoip http server starting on", c.ServerAddr())
-	s := &http.Server{
-		Addr:         c.ServerAddr(),
+	servers, err := newServers(c, f)
+	if err != nil {
+		log.Fatal(err)
+	}
+	errc := make(chan error, len(servers))
+	for _, s := range servers {
+		go func(s *http.Server) {
+			if s.TLSConfig == nil {
+				log.Println("freegeoip http server starting on", s.Addr)
+				errc <- s.ListenAndServe()
+			} else {
+				log.Println("freegeoip https server starting on", s.Addr)
+				errc <- s.ListenAndServeTLS("", "")
+			}
+		}(s)
+	}
+	log.Fatal(<-errc)
+}
+
+// newServers returns the HTTP server, unless -port is 0 with HTTPS, and
+// the HTTPS server when configured, whose certificates are reloaded
+// when they change.
+func newServers(c *Config, f http.Handler) ([]*http.Server, error) {
+	config, files, err := c.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	var servers []*http.Server
+	if c.Port != 0 || config == nil {
+		servers = append(servers, c.newServer(c.ServerAddr(), f))
+	}
+	if config != nil {
+		go files.watch(nil)
+		s := c.newServer(c.TLSServerAddr(), f)
+		s.TLSConfig = config
+		servers = append(servers, s)
+	}
+	return servers, nil
+}
+
+func (c *Config) newServer(addr string, f http.Handler) *http.Server {
+	return &http.Server{
+		Addr:         addr,
 		Handler:      f,
 		ReadTimeout:  c.ReadTimeout,
 		WriteTimeout: c.WriteTimeout,
 		ErrorLog:     c.errorLogger(),
 	}
-	log.Fatal(s.ListenAndServe())
+}
+
+// runMetricsServer serves the metrics on their own listener, to keep
+// them off the public one.
+func runMetricsServer(c *Config, m *metrics) {
+	log.Println("freegeoip metrics server starting on", c.MetricsAddr)
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", m)
+	log.Fatal(c.newServer(c.MetricsAddr, mux).ListenAndServe())
 }
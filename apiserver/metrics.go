@@ -0,0 +1,294 @@
+// Copyright 2009 The freegeoip authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package apiserver
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fiorix/freegeoip"
+)
+
+// Upper bounds of the request duration histogram buckets, in seconds.
+var metricsBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Maximum number of countries counted by lookups, so that the number of
+// series is bounded whatever the database. Other countries are counted
+// as "other".
+var maxCountryLabels = 300
+
+// metrics are the Prometheus metrics of the server. Database metrics
+// are fed by its events, see eventSink.
+type metrics struct {
+	db *freegeoip.DB
+
+	requests     *counterVec
+	durations    *histogramVec
+	lookupErrors *counterVec
+	countries    *counterVec
+	dbEvents     *counterVec
+	cache        cacheStats
+}
+
+// cacheStats counts the hits and misses of the Accept-Language cache.
+type cacheStats struct {
+	hits, misses uint64
+}
+
+func (s *cacheStats) add(hit bool) {
+	if s == nil {
+		return
+	}
+	if hit {
+		atomic.AddUint64(&s.hits, 1)
+	} else {
+		atomic.AddUint64(&s.misses, 1)
+	}
+}
+
+func newMetrics(db *freegeoip.DB) *metrics {
+	return &metrics{
+		db: db,
+		requests: newCounterVec("freegeoip_http_requests_total",
+			"HTTP requests by route and status code.", "route", "code"),
+		durations: newHistogramVec("freegeoip_http_request_duration_seconds",
+			"Duration of HTTP requests by route and status code.", "route", "code"),
+		lookupErrors: newCounterVec("freegeoip_lookup_errors_total",
+			"Failed lookups by reason.", "reason"),
+		countries: newCounterVec("freegeoip_lookups_total",
+			"Lookups by country code of the result.", "country"),
+		dbEvents: newCounterVec("freegeoip_database_events_total",
+			"Database events by type: loaded, update_failed, rolled_back and stale.", "type"),
+	}
+}
+
+// instrument counts and times the requests of a route.
+func (m *metrics) instrument(route string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w, code: http.StatusOK}
+		h(sw, r)
+		code := strconv.Itoa(sw.code)
+		m.requests.add(1, route, code)
+		m.durations.observe(time.Since(start).Seconds(), route, code)
+	}
+}
+
+// lookup counts a lookup by its result.
+func (m *metrics) lookup(rr *responseRecord, err *lookupError) {
+	switch {
+	case err == errHostNotFound:
+		m.lookupErrors.add(1, "host_not_found")
+	case err == errHostTimeout:
+		m.lookupErrors.add(1, "host_timeout")
+	case err != nil && err.status == http.StatusNotFound:
+		m.lookupErrors.add(1, "no_build")
+	case err != nil:
+		m.lookupErrors.add(1, "unavailable")
+	default:
+		country := rr.CountryCode
+		if country == "" {
+			country = "unknown"
+		}
+		m.countries.addBounded(1, maxCountryLabels, "other", country)
+	}
+}
+
+func (m *metrics) send(e *dbEvent) {
+	m.dbEvents.add(1, e.Type)
+}
+
+func (m *metrics) close() {}
+
+// ServeHTTP writes the metrics in the Prometheus text format.
+func (m *metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	b := bufio.NewWriter(w)
+	m.requests.write(b)
+	m.durations.write(b)
+	m.lookupErrors.write(b)
+	m.countries.write(b)
+	writeCounter(b, "freegeoip_language_cache_requests_total",
+		"Lookups of the Accept-Language cache by result.", "result",
+		map[string]float64{
+			"hit":  float64(atomic.LoadUint64(&m.cache.hits)),
+			"miss": float64(atomic.LoadUint64(&m.cache.misses)),
+		})
+	m.dbEvents.write(b)
+	date, build := m.db.Date(), m.db.BuildDate()
+	if build.Unix() > 0 {
+		date = build
+	}
+	loaded, age := 0.0, 0.0
+	if !date.IsZero() {
+		loaded, age = 1, time.Since(date).Seconds()
+	}
+	writeGauge(b, "freegeoip_database_loaded", "Whether a database is loaded.", loaded)
+	writeGauge(b, "freegeoip_database_age_seconds",
+		"Age of the database, from its build date or else its file date.", age)
+	stale := 0.0
+	if m.db.Stale() {
+		stale = 1
+	}
+	writeGauge(b, "freegeoip_database_stale", "Whether the database is stale.", stale)
+	b.Flush()
+}
+
+// statusWriter records the status code of a response.
+type statusWriter struct {
+	http.ResponseWriter
+	code int
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	w.code = code
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// counterVec is a counter with labels.
+type counterVec struct {
+	name, help string
+	labels     []string
+	mu         sync.Mutex
+	values     map[string]float64 // By rendered labels.
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{name: name, help: help, labels: labels, values: make(map[string]float64)}
+}
+
+func (c *counterVec) add(v float64, labelValues ...string) {
+	key := renderLabels(c.labels, labelValues)
+	c.mu.Lock()
+	c.values[key] += v
+	c.mu.Unlock()
+}
+
+// addBounded adds to the counter of a single label value, or of other
+// once there are max values.
+func (c *counterVec) addBounded(v float64, max int, other, labelValue string) {
+	key := renderLabels(c.labels, []string{labelValue})
+	c.mu.Lock()
+	if _, ok := c.values[key]; !ok && len(c.values) >= max {
+		key = renderLabels(c.labels, []string{other})
+	}
+	c.values[key] += v
+	c.mu.Unlock()
+}
+
+func (c *counterVec) write(w *bufio.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s{%s} %s\n", c.name, key, formatValue(c.values[key]))
+	}
+}
+
+// histogramVec is a histogram with labels.
+type histogramVec struct {
+	name, help string
+	labels     []string
+	mu         sync.Mutex
+	values     map[string]*histogram // By rendered labels.
+}
+
+type histogram struct {
+	counts []uint64 // By bucket, not cumulative.
+	count  uint64
+	sum    float64
+}
+
+func newHistogramVec(name, help string, labels ...string) *histogramVec {
+	return &histogramVec{name: name, help: help, labels: labels, values: make(map[string]*histogram)}
+}
+
+func (h *histogramVec) observe(v float64, labelValues ...string) {
+	key := renderLabels(h.labels, labelValues)
+	i := sort.SearchFloat64s(metricsBuckets, v)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	hv := h.values[key]
+	if hv == nil {
+		hv = &histogram{counts: make([]uint64, len(metricsBuckets))}
+		h.values[key] = hv
+	}
+	if i < len(metricsBuckets) {
+		hv.counts[i]++
+	}
+	hv.count++
+	hv.sum += v
+}
+
+func (h *histogramVec) write(w *bufio.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	keys := make([]string, 0, len(h.values))
+	for key := range h.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		hv := h.values[key]
+		var n uint64
+		for i, le := range metricsBuckets {
+			n += hv.counts[i]
+			fmt.Fprintf(w, "%s_bucket{%s,le=\"%s\"} %d\n", h.name, key, formatValue(le), n)
+		}
+		fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n", h.name, key, hv.count)
+		fmt.Fprintf(w, "%s_sum{%s} %s\n", h.name, key, formatValue(hv.sum))
+		fmt.Fprintf(w, "%s_count{%s} %d\n", h.name, key, hv.count)
+	}
+}
+
+func writeCounter(w *bufio.Writer, name, help, label string, values map[string]float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", name, help, name)
+	for _, v := range sortedKeys(values) {
+		fmt.Fprintf(w, "%s{%s} %s\n", name, renderLabels([]string{label}, []string{v}), formatValue(values[v]))
+	}
+}
+
+func writeGauge(w *bufio.Writer, name, help string, v float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %s\n", name, help, name, name, formatValue(v))
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// renderLabels renders label pairs as in the text format, e.g.
+// route="/json/:host",code="200".
+func renderLabels(names, values []string) string {
+	var b strings.Builder
+	for i, name := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(name)
+		b.WriteString(`="`)
+		labelEscaper.WriteString(&b, values[i])
+		b.WriteByte('"')
+	}
+	return b.String()
+}
+
+func formatValue(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,132 @@
+// Copyright 2009 The freegeoip authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package apiserver
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// getMetrics returns the /metrics of a handler once they have the
+// given line, waiting for the database events to be processed.
+func getMetrics(t *testing.T, f http.Handler, line string) string {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		w := httptest.NewRecorder()
+		f.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Unexpected response: %d %s", w.Code, w.Body.String())
+		}
+		if strings.Contains(w.Body.String(), "\n"+line+"\n") {
+			return w.Body.String()
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %q in:\n%s", line, w.Body.String())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	c := newTestConfig(t)
+	c.Metrics = true
+	f, err := openHandler(t, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{
+		"/json/8.8.8.8",
+		"/json/200.1.2.3",
+		"/csv/10.0.0.1",
+		"/json/host.invalid",
+	} {
+		r := httptest.NewRequest("GET", path, nil)
+		r.Header.Set("Accept-Language", "de")
+		f.ServeHTTP(httptest.NewRecorder(), r)
+	}
+	body := getMetrics(t, f, `freegeoip_database_events_total{type="loaded"} 1`)
+	for _, line := range []string{
+		`freegeoip_http_requests_total{route="/json/:host",code="200"} 2`,
+		`freegeoip_http_requests_total{route="/json/:host",code="404"} 1`,
+		`freegeoip_http_requests_total{route="/csv/:host",code="200"} 1`,
+		`freegeoip_http_request_duration_seconds_count{route="/json/:host",code="200"} 2`,
+		`freegeoip_http_request_duration_seconds_bucket{route="/json/:host",code="200",le="+Inf"} 2`,
+		`freegeoip_lookup_errors_total{reason="host_not_found"} 1`,
+		`freegeoip_lookups_total{country="US"} 1`,
+		`freegeoip_lookups_total{country="VE"} 1`,
+		`freegeoip_lookups_total{country="unknown"} 1`,
+		`freegeoip_language_cache_requests_total{result="hit"} 3`,
+		`freegeoip_language_cache_requests_total{result="miss"} 1`,
+		`freegeoip_database_loaded 1`,
+		`freegeoip_database_stale 0`,
+	} {
+		if !strings.Contains(body, "\n"+line+"\n") {
+			t.Errorf("Missing %q in:\n%s", line, body)
+		}
+	}
+}
+
+func TestMetricsNotServed(t *testing.T) {
+	for _, tc := range []struct {
+		metrics bool
+		addr    string
+	}{
+		{false, ""},
+		{true, "localhost:8888"}, // On their own listener.
+	} {
+		c := newTestConfig(t)
+		c.Metrics, c.MetricsAddr = tc.metrics, tc.addr
+		f, err := openHandler(t, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		f.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+		if w.Code != http.StatusNotFound {
+			t.Errorf("%+v: unexpected /metrics status: %d", tc, w.Code)
+		}
+	}
+}
+
+func TestMetricsDisabled(t *testing.T) {
+	f, m, err := newHandler(newTestConfig(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.(io.Closer).Close()
+	if m != nil {
+		t.Fatal("Unexpected metrics without -metrics")
+	}
+	w := httptest.NewRecorder()
+	f.ServeHTTP(w, httptest.NewRequest("GET", "/json/8.8.8.8", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Unexpected response: %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestCountryLabelsBounded(t *testing.T) {
+	c := newCounterVec("test_total", "Test.", "country")
+	for _, country := range []string{"US", "DE", "FR", "US", "JP"} {
+		c.addBounded(1, 2, "other", country)
+	}
+	var b bytes.Buffer
+	w := bufio.NewWriter(&b)
+	c.write(w)
+	w.Flush()
+	want := "# HELP test_total Test.\n# TYPE test_total counter\n" +
+		"test_total{country=\"DE\"} 1\n" +
+		"test_total{country=\"US\"} 2\n" +
+		"test_total{country=\"other\"} 2\n"
+	if b.String() != want {
+		t.Errorf("Unexpected output:\nhave %q\nwant %q", b.String(), want)
+	}
+}
@@ -0,0 +1,106 @@
+// Copyright 2009 The freegeoip authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package apiserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/fiorix/freegeoip"
+)
+
+func TestPeers(t *testing.T) {
+	c := newTestConfig(t)
+	c.ServeDB, c.PeerSecret = true, "s3cret"
+	f, err := openHandler(t, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer := httptest.NewServer(f)
+	defer peer.Close()
+
+	for _, tc := range []struct {
+		auth string
+		code int
+	}{
+		{"", http.StatusUnauthorized},
+		{"Bearer wrong", http.StatusUnauthorized},
+		{"s3cret", http.StatusUnauthorized},
+		{"Bearer s3cret", http.StatusOK},
+	} {
+		req, _ := http.NewRequest("GET", peer.URL+"/admin/db", nil)
+		if tc.auth != "" {
+			req.Header.Set("Authorization", tc.auth)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tc.code {
+			t.Fatalf("Authorization %q: unexpected response: %s", tc.auth, resp.Status)
+		}
+		if tc.code == http.StatusOK && resp.Header.Get(freegeoip.ChecksumHeader) == "" {
+			t.Fatalf("Unexpected response: %s %v", resp.Status, resp.Header)
+		}
+	}
+
+	var upstreamHits int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&upstreamHits, 1)
+		http.Error(w, "rate limited", http.StatusTooManyRequests)
+	}))
+	defer upstream.Close()
+
+	c = NewConfig()
+	c.Silent = true
+	c.DB = upstream.URL + "/db.gz"
+	c.DBCacheFile = filepath.Join(t.TempDir(), "db.gz")
+	c.Peers = "http://127.0.0.1:1/admin/db," + peer.URL + "/admin/db"
+	c.PeerSecret = "s3cret"
+	f, err = openHandler(t, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		w := httptest.NewRecorder()
+		f.ServeHTTP(w, httptest.NewRequest("GET", "/json/8.8.8.8", nil))
+		if w.Code == http.StatusOK {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for the database from the peer")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := atomic.LoadInt32(&upstreamHits); n != 0 {
+		t.Fatalf("Unexpected downloads from upstream: %d", n)
+	}
+}
+
+func TestServeDBRequiresSecret(t *testing.T) {
+	c := newTestConfig(t)
+	c.ServeDB = true
+	if _, err := openHandler(t, c); err == nil {
+		t.Fatal("Unexpected handler serving the database without a peer secret")
+	}
+}
+
+func TestServeDBDisabled(t *testing.T) {
+	f, err := newTestHandler(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	f.ServeHTTP(w, httptest.NewRequest("GET", "/admin/db", nil))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("Unexpected status: %d", w.Code)
+	}
+}
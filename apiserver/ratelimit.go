@@ -0,0 +1,264 @@
+// Copyright 2009 The freegeoip authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package apiserver
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RateLimitStore keeps the token buckets of rate limited clients. The
+// in-memory store of each server is used by default. A store shared by
+// several instances, e.g. backed by Redis, enforces a single limit
+// across them. Implementations must be safe for concurrent use.
+type RateLimitStore interface {
+	// Take takes n tokens from the bucket of key, which holds up to
+	// burst tokens and is refilled at rate tokens per second.
+	Take(key string, n int, rate float64, burst int, now time.Time) (RateLimitResult, error)
+}
+
+// RateLimitResult is the state of a bucket after a call to Take.
+type RateLimitResult struct {
+	Allowed    bool          // Whether the tokens were taken.
+	Remaining  int           // Tokens left in the bucket.
+	Reset      time.Duration // Time until the bucket is full.
+	RetryAfter time.Duration // Time until the tokens are available, if not allowed.
+}
+
+// Interval between sweeps of full buckets from a memoryStore.
+var memoryStoreSweepInterval = time.Minute
+
+// memoryStore is a RateLimitStore in memory.
+type memoryStore struct {
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+	rate   float64
+	burst  float64
+}
+
+// fill refills the bucket up to now.
+func (b *tokenBucket) fill(now time.Time) {
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+}
+
+// NewMemoryRateLimitStore returns a RateLimitStore that keeps buckets
+// in memory, forgetting those that are full.
+func NewMemoryRateLimitStore() RateLimitStore {
+	return &memoryStore{buckets: make(map[string]*tokenBucket)}
+}
+
+func (s *memoryStore) Take(key string, n int, rate float64, burst int, now time.Time) (RateLimitResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if now.Sub(s.lastSweep) > memoryStoreSweepInterval {
+		s.sweep(now)
+	}
+	b := s.buckets[key]
+	if b == nil {
+		b = &tokenBucket{tokens: float64(burst), last: now}
+		s.buckets[key] = b
+	}
+	b.rate, b.burst = rate, float64(burst)
+	b.fill(now)
+	res := RateLimitResult{}
+	if b.tokens >= float64(n) {
+		b.tokens -= float64(n)
+		res.Allowed = true
+	} else {
+		res.RetryAfter = seconds((float64(n) - b.tokens) / rate)
+	}
+	res.Remaining = int(b.tokens)
+	res.Reset = seconds((float64(burst) - b.tokens) / rate)
+	return res, nil
+}
+
+// sweep forgets the buckets that are full, which is the state of a new
+// bucket. The lock must be held.
+func (s *memoryStore) sweep(now time.Time) {
+	for key, b := range s.buckets {
+		if b.fill(now); b.tokens >= b.burst {
+			delete(s.buckets, key)
+		}
+	}
+	s.lastSweep = now
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
+
+// rateLimiter limits requests per client, by API key or else by IP.
+// Clients with a rate of 0 are not limited.
+type rateLimiter struct {
+	store   RateLimitStore
+	ipRate  float64
+	keyRate float64      // Per verified API key, limit by IP if 0.
+	burst   int          // Rate rounded up if 0.
+	proxies []*net.IPNet // Trusted to set X-Forwarded-For.
+}
+
+func newRateLimiter(c *Config, proxies []*net.IPNet) *rateLimiter {
+	store := c.RateLimitStore
+	if store == nil {
+		store = NewMemoryRateLimitStore()
+	}
+	return &rateLimiter{
+		store:   store,
+		ipRate:  c.RateLimit,
+		keyRate: c.RateLimitKey,
+		burst:   c.RateLimitBurst,
+		proxies: proxies,
+	}
+}
+
+// limit is a middleware that rejects requests over the rate limit of
+// their client with 429 Too Many Requests.
+func (l *rateLimiter) limit(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if l.take(w, r, 1) {
+			next(w, r)
+		}
+	}
+}
+
+// take takes n tokens from the bucket of the client of r, e.g. one per
+// host of a batch, and writes the rate limit headers. Requests over the
+// limit get a 429 Too Many Requests and false is returned. Failures of
+// the store let requests through.
+func (l *rateLimiter) take(w http.ResponseWriter, r *http.Request, n int) bool {
+	key, rate, burst := l.client(r)
+	if rate <= 0 {
+		return true
+	}
+	if burst <= 0 {
+		burst = int(math.Ceil(rate))
+	}
+	if n > burst {
+		http.Error(w, fmt.Sprintf("Too many hosts for the rate limit, the maximum is %d.", burst),
+			http.StatusTooManyRequests)
+		return false
+	}
+	res, err := l.store.Take(key, n, rate, burst, time.Now())
+	if err != nil {
+		log.Println("rate limit store failed:", err)
+		return true
+	}
+	h := w.Header()
+	h.Set("X-RateLimit-Limit", strconv.Itoa(burst))
+	h.Set("X-RateLimit-Remaining", strconv.Itoa(res.Remaining))
+	h.Set("X-RateLimit-Reset", strconv.Itoa(ceilSeconds(res.Reset)))
+	if !res.Allowed {
+		h.Set("Retry-After", strconv.Itoa(ceilSeconds(res.RetryAfter)))
+		http.Error(w, "Too many requests, try again later.", http.StatusTooManyRequests)
+		return false
+	}
+	return true
+}
+
+// client returns the bucket key, rate and burst of a request. Only the
+// keys verified by authenticate have their own buckets, since anyone
+// can send new keys to get new buckets. Other clients are limited by
+// address, see clientAddr, and IPv6 clients by /64, the smallest
+// network usually assigned to a host.
+func (l *rateLimiter) client(r *http.Request) (string, float64, int) {
+	if key := keyFromContext(r.Context()); key != nil {
+		rate, burst := key.RateLimit, key.RateLimitBurst
+		if rate <= 0 {
+			rate = l.keyRate
+		}
+		if burst <= 0 {
+			burst = l.burst
+		}
+		if rate > 0 {
+			return "key:" + key.Name, rate, burst
+		}
+	}
+	host := l.clientAddr(r)
+	if ip := net.ParseIP(host); ip != nil && ip.To4() == nil {
+		host = ip.Mask(net.CIDRMask(64, 128)).String() + "/64"
+	}
+	return "ip:" + host, l.ipRate, l.burst
+}
+
+// clientAddr returns the address of the connection of a request or,
+// if it is a trusted proxy, the rightmost address of X-Forwarded-For
+// that was not added by one. Clients choose the other entries, e.g.
+// the leftmost one used by -use-x-forwarded-for.
+func (l *rateLimiter) clientAddr(r *http.Request) string {
+	addr, ok := r.Context().Value(peerContextKey{}).(string)
+	if !ok {
+		addr = r.RemoteAddr
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	if !l.trusted(host) {
+		return host
+	}
+	var hops []string
+	for _, v := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(v, ",")...)
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if net.ParseIP(hop) == nil {
+			break // Keep the last proxy.
+		}
+		host = hop
+		if !l.trusted(hop) {
+			break
+		}
+	}
+	return host
+}
+
+func (l *rateLimiter) trusted(host string) bool {
+	ip := net.ParseIP(host)
+	for _, n := range l.proxies {
+		if ip != nil && n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+type peerContextKey struct{}
+
+// savePeer is a middleware that keeps the address of the connection for
+// clientAddr, since -use-x-forwarded-for replaces it later in the chain.
+func savePeer(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		next(w, r.WithContext(context.WithValue(r.Context(), peerContextKey{}, r.RemoteAddr)))
+	}
+}
+
+// requestAPIKey returns the API key of a request, from the X-API-Key
+// header or the key parameter.
+func requestAPIKey(r *http.Request) string {
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		return key
+	}
+	return r.URL.Query().Get("key")
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
@@ -0,0 +1,192 @@
+// Copyright 2009 The freegeoip authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package apiserver
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestMemoryRateLimitStore(t *testing.T) {
+	s := NewMemoryRateLimitStore()
+	now := time.Now()
+	for i, want := range []RateLimitResult{
+		{Allowed: true, Remaining: 1, Reset: time.Second},
+		{Allowed: true, Remaining: 0, Reset: 2 * time.Second},
+		{Allowed: false, Remaining: 0, Reset: 2 * time.Second, RetryAfter: time.Second},
+	} {
+		have, err := s.Take("a", 1, 1, 2, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if have != want {
+			t.Fatalf("Take %d: have %+v, want %+v", i, have, want)
+		}
+	}
+	if res, _ := s.Take("b", 1, 1, 2, now); !res.Allowed {
+		t.Fatal("Unexpected limit of another key")
+	}
+	if res, _ := s.Take("a", 1, 1, 2, now.Add(time.Second)); !res.Allowed {
+		t.Fatal("Unexpected limit after the bucket refilled")
+	}
+
+	// Full buckets are forgotten.
+	ms := s.(*memoryStore)
+	s.Take("c", 1, 1, 2, now.Add(2*memoryStoreSweepInterval))
+	if len(ms.buckets) != 1 {
+		t.Fatalf("Unexpected buckets after a sweep: %d", len(ms.buckets))
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	c := newTestConfig(t)
+	c.RateLimit = 1
+	c.RateLimitBurst = 2
+	c.RateLimitKey = 100
+	c.UseXForwardedFor = true
+	c.TrustedProxies = "192.0.2.3"
+	f, err := openHandler(t, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	get := func(remoteAddr, xff, key string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/json/8.8.8.8", nil)
+		r.RemoteAddr = remoteAddr
+		if xff != "" {
+			r.Header.Set("X-Forwarded-For", xff)
+		}
+		if key != "" {
+			r.Header.Set("X-API-Key", key)
+		}
+		w := httptest.NewRecorder()
+		f.ServeHTTP(w, r)
+		return w
+	}
+	for i, code := range []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests} {
+		w := get("192.0.2.1:1234", "", "")
+		if w.Code != code {
+			t.Fatalf("Request %d: unexpected status: %d", i, w.Code)
+		}
+		if w.Header().Get("X-RateLimit-Limit") != "2" {
+			t.Fatalf("Request %d: unexpected headers: %v", i, w.Header())
+		}
+		if code == http.StatusTooManyRequests && w.Header().Get("Retry-After") != "1" {
+			t.Fatalf("Unexpected Retry-After: %q", w.Header().Get("Retry-After"))
+		}
+	}
+	if w := get("192.0.2.2:1234", "", ""); w.Code != http.StatusOK {
+		t.Errorf("Unexpected limit of another client: %d", w.Code)
+	}
+	if w := get("192.0.2.3:1234", "192.0.2.1", ""); w.Code != http.StatusTooManyRequests {
+		t.Errorf("Unexpected status of a forwarded client: %d", w.Code)
+	}
+	if w := get("192.0.2.1:1234", "", "secret"); w.Code != http.StatusTooManyRequests {
+		t.Errorf("Unexpected status with an API key: %d", w.Code)
+	}
+	get("[2001:db8::1]:1234", "", "")
+	get("[2001:db8::2]:1234", "", "")
+	if w := get("[2001:db8::3]:1234", "", ""); w.Code != http.StatusTooManyRequests {
+		t.Errorf("Unexpected status of a client in the same /64: %d", w.Code)
+	}
+}
+
+func TestRateLimitRotatingKeys(t *testing.T) {
+	c := newTestConfig(t)
+	c.RateLimit = 1
+	c.RateLimitKey = 1
+	c.RateLimitStore = NewMemoryRateLimitStore()
+	f, err := openHandler(t, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Without -api-keys-file a new key on each request neither escapes
+	// the limit of the client IP nor adds buckets.
+	for i := 0; i < 5; i++ {
+		w := httptest.NewRecorder()
+		f.ServeHTTP(w, httptest.NewRequest("GET", fmt.Sprintf("/json/8.8.8.8?key=k%d", i), nil))
+		want := http.StatusTooManyRequests
+		if i == 0 {
+			want = http.StatusOK
+		}
+		if w.Code != want {
+			t.Fatalf("Request %d: unexpected status: %d", i, w.Code)
+		}
+	}
+	if n := len(c.RateLimitStore.(*memoryStore).buckets); n != 1 {
+		t.Errorf("Unexpected buckets: %d", n)
+	}
+}
+
+func TestRateLimitRotatingForwardedFor(t *testing.T) {
+	c := newTestConfig(t)
+	c.RateLimit = 1
+	c.UseXForwardedFor = true
+	c.TrustedProxies = "10.0.0.0/8, 192.0.2.3"
+	f, err := openHandler(t, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Clients choose all but the entries added by trusted proxies, so a
+	// new X-Forwarded-For on each request must not escape the limit.
+	for _, tc := range []struct {
+		peer, xff, client string
+	}{
+		{"198.51.100.1:1234", "203.0.113.%d", "the connection"},
+		{"192.0.2.3:1234", "203.0.113.%d, 198.51.100.2", "the proxy"},
+		{"192.0.2.3:1234", "203.0.113.%d, 198.51.100.3, 10.0.0.1", "the proxies"},
+		{"192.0.2.3:1234", "203.0.113.%d, bogus, 10.0.0.2", "the last proxy"},
+	} {
+		for i := 0; i < 5; i++ {
+			r := httptest.NewRequest("GET", "/json/8.8.8.8", nil)
+			r.RemoteAddr = tc.peer
+			r.Header.Set("X-Forwarded-For", fmt.Sprintf(tc.xff, i))
+			w := httptest.NewRecorder()
+			f.ServeHTTP(w, r)
+			want := http.StatusTooManyRequests
+			if i == 0 {
+				want = http.StatusOK
+			}
+			if w.Code != want {
+				t.Fatalf("Client of %s, request %d: unexpected status: %d", tc.client, i, w.Code)
+			}
+		}
+	}
+}
+
+func TestTrustedProxies(t *testing.T) {
+	c := newTestConfig(t)
+	c.RateLimit = 1
+	c.TrustedProxies = "10.0.0.0/33"
+	if _, err := openHandler(t, c); err == nil {
+		t.Fatal("Unexpected handler with an invalid trusted proxy")
+	}
+}
+
+type failingStore struct{}
+
+func (failingStore) Take(string, int, float64, int, time.Time) (RateLimitResult, error) {
+	return RateLimitResult{}, errors.New("unavailable")
+}
+
+func TestRateLimitStoreFailure(t *testing.T) {
+	c := newTestConfig(t)
+	c.RateLimit = 1
+	c.RateLimitStore = failingStore{}
+	f, err := openHandler(t, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		w := httptest.NewRecorder()
+		f.ServeHTTP(w, httptest.NewRequest("GET", "/json/8.8.8.8", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Unexpected status with a failing store: %d", w.Code)
+		}
+	}
+}
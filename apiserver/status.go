@@ -0,0 +1,130 @@
+// Copyright 2009 The freegeoip authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package apiserver
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// updateStatus is an event sink that keeps the result of the last
+// database update, for the /status endpoint.
+type updateStatus struct {
+	mu   sync.Mutex
+	last *dbEvent
+}
+
+func (s *updateStatus) send(e *dbEvent) {
+	if e.Type == eventStale {
+		return // Not the result of an update.
+	}
+	s.mu.Lock()
+	s.last = e
+	s.mu.Unlock()
+}
+
+func (s *updateStatus) close() {}
+
+func (s *updateStatus) get() *dbEvent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.last
+}
+
+// healthz reports that the process is alive and serving.
+func (f *apiHandler) healthz(w http.ResponseWriter, r *http.Request) {
+	io.WriteString(w, "ok\n")
+}
+
+// readyz reports whether the server can answer lookups, for load
+// balancers and orchestrators.
+func (f *apiHandler) readyz(w http.ResponseWriter, r *http.Request) {
+	if reason := f.notReady(); reason != "" {
+		http.Error(w, reason, http.StatusServiceUnavailable)
+		return
+	}
+	io.WriteString(w, "ok\n")
+}
+
+// notReady returns why the server can't answer lookups, or an empty
+// string if it is ready.
+func (f *apiHandler) notReady() string {
+	switch {
+	case f.db.Date().IsZero():
+		return "database not loaded"
+	case f.conf.StaleNotReady && f.db.Stale():
+		return "database is stale"
+	}
+	return ""
+}
+
+// serverStatus is the response of the /status endpoint.
+type serverStatus struct {
+	Ready         bool          `json:"ready"`
+	Reason        string        `json:"reason,omitempty"`
+	Version       string        `json:"version"`
+	UptimeSeconds int64         `json:"uptime_seconds"`
+	Database      dbStatus      `json:"database"`
+	LastUpdate    *updateResult `json:"last_update"`
+}
+
+type dbStatus struct {
+	Source     string     `json:"source"`
+	File       string     `json:"file"`
+	Date       *time.Time `json:"date"`
+	BuildEpoch int64      `json:"build_epoch,omitempty"`
+	Checksum   string     `json:"checksum,omitempty"`
+	Stale      bool       `json:"stale"`
+}
+
+type updateResult struct {
+	Result string    `json:"result"`
+	Time   time.Time `json:"time"`
+	Error  string    `json:"error,omitempty"`
+}
+
+// status reports the state of the server and its database as JSON.
+func (f *apiHandler) status(w http.ResponseWriter, r *http.Request) {
+	s := &serverStatus{
+		Reason:        f.notReady(),
+		Version:       Version,
+		UptimeSeconds: int64(time.Since(f.started) / time.Second),
+		Database: dbStatus{
+			Source:   redactURL(f.conf.DB),
+			File:     f.db.File(),
+			Checksum: f.db.Checksum(),
+			Stale:    f.db.Stale(),
+		},
+	}
+	s.Ready = s.Reason == ""
+	if date := f.db.Date(); !date.IsZero() {
+		s.Database.Date = &date
+	}
+	if date := f.db.BuildDate(); date.Unix() > 0 {
+		s.Database.BuildEpoch = date.Unix()
+	}
+	if e := f.updates.get(); e != nil {
+		s.LastUpdate = &updateResult{Result: e.Type, Time: e.Time, Error: e.Error}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	json.NewEncoder(w).Encode(s)
+}
+
+// redactURL removes credentials from a database URL, such as the
+// license key of MaxMind downloads. Files are returned as is.
+func redactURL(s string) string {
+	u, err := url.Parse(s)
+	if err != nil || u.Scheme == "" {
+		return s
+	}
+	u.User = nil
+	u.RawQuery = ""
+	return u.String()
+}
@@ -0,0 +1,124 @@
+// Copyright 2009 The freegeoip authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package apiserver
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fiorix/freegeoip/internal/testdb"
+)
+
+// getStatus returns the /status of a handler once its last update
+// result is result, waiting for the database events to be processed.
+func getStatus(t *testing.T, f http.Handler, path, result string) *serverStatus {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		w := httptest.NewRecorder()
+		f.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Unexpected response: %d %s", w.Code, w.Body.String())
+		}
+		var s serverStatus
+		if err := json.NewDecoder(w.Body).Decode(&s); err != nil {
+			t.Fatal(err)
+		}
+		if s.LastUpdate != nil && s.LastUpdate.Result == result {
+			return &s
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for the %s update result: %+v", result, s.LastUpdate)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestStatus(t *testing.T) {
+	c := newTestConfig(t)
+	f, err := openHandler(t, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"/healthz", "/readyz"} {
+		w := httptest.NewRecorder()
+		f.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != http.StatusOK || w.Body.String() != "ok\n" {
+			t.Errorf("%s: unexpected response: %d %q", path, w.Code, w.Body.String())
+		}
+	}
+	s := getStatus(t, f, "/status", eventLoaded)
+	if !s.Ready || s.Reason != "" || s.Version != Version {
+		t.Errorf("Unexpected status: %+v", s)
+	}
+	db := s.Database
+	if db.Source != c.DB || db.File != c.DB || db.Date == nil || len(db.Checksum) != 32 ||
+		db.BuildEpoch != testdb.BuildDate.Unix() || db.Stale {
+		t.Errorf("Unexpected database status: %+v", db)
+	}
+}
+
+func TestStatusNotLoaded(t *testing.T) {
+	upstream := httptest.NewServer(http.NotFoundHandler())
+	defer upstream.Close()
+	c := NewConfig()
+	c.DB = upstream.URL + "/db.gz?license_key=secret"
+	c.DBCacheFile = filepath.Join(t.TempDir(), "db.gz")
+	c.Silent = true
+	f, err := openHandler(t, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	f.ServeHTTP(w, httptest.NewRequest("GET", "/healthz", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("Unexpected /healthz status: %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	f.ServeHTTP(w, httptest.NewRequest("GET", "/readyz", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Unexpected /readyz status: %d", w.Code)
+	}
+	s := getStatus(t, f, "/status", eventUpdateFailed)
+	if s.Ready || s.Reason != "database not loaded" || s.LastUpdate.Error == "" {
+		t.Errorf("Unexpected status: %+v", s)
+	}
+	if s.Database.Source != upstream.URL+"/db.gz" || s.Database.Date != nil {
+		t.Errorf("Unexpected database status: %+v", s.Database)
+	}
+}
+
+func TestStatusPrefix(t *testing.T) {
+	c := newTestConfig(t)
+	c.StatusPrefix = "/internal/"
+	f, err := openHandler(t, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for path, code := range map[string]int{
+		"/internal/healthz": http.StatusOK,
+		"/internal/readyz":  http.StatusOK,
+		"/internal/status":  http.StatusOK,
+		"/healthz":          http.StatusNotFound,
+		"/status":           http.StatusNotFound,
+	} {
+		w := httptest.NewRecorder()
+		f.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != code {
+			t.Errorf("%s: unexpected status: %d", path, w.Code)
+		}
+	}
+	for _, prefix := range []string{"internal", "/:name", "/*all"} {
+		c := newTestConfig(t)
+		c.StatusPrefix = prefix
+		if _, err := openHandler(t, c); err == nil {
+			t.Errorf("Unexpected handler with status prefix %q", prefix)
+		}
+	}
+}
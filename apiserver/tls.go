@@ -0,0 +1,138 @@
+// Copyright 2009 The freegeoip authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package apiserver
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Interval between checks of the certificate files for changes.
+var tlsReloadInterval = 10 * time.Second
+
+// tlsFiles are the certificate, key and client CA files of the HTTPS
+// server, reloaded when they change so that rotated certificates are
+// used without a restart.
+type tlsFiles struct {
+	cert, key, clientCA string // No client certificates if clientCA is empty.
+	interval            time.Duration
+	mu                  sync.RWMutex
+	config              *tls.Config // Of the current files.
+	stamps              []fileStamp
+}
+
+// fileStamp identifies a version of a file.
+type fileStamp struct {
+	modtime time.Time
+	size    int64
+}
+
+func newTLSFiles(cert, key, clientCA string) (*tls.Config, *tlsFiles, error) {
+	t := &tlsFiles{cert: cert, key: key, clientCA: clientCA, interval: tlsReloadInterval}
+	if err := t.load(); err != nil {
+		return nil, nil, err
+	}
+	// Only the callbacks are set: GetCertificate satisfies http.Server,
+	// which requires a certificate source to serve TLS, and
+	// GetConfigForClient returns the config of the current files.
+	config := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		GetCertificate:     t.getCertificate,
+		GetConfigForClient: t.getConfigForClient,
+	}
+	return config, t, nil
+}
+
+func (t *tlsFiles) files() []string {
+	if t.clientCA == "" {
+		return []string{t.cert, t.key}
+	}
+	return []string{t.cert, t.key, t.clientCA}
+}
+
+// load reads the files if any of them changed since the last load.
+func (t *tlsFiles) load() error {
+	files := t.files()
+	stamps := make([]fileStamp, len(files))
+	for i, name := range files {
+		stat, err := os.Stat(name)
+		if err != nil {
+			return err
+		}
+		stamps[i] = fileStamp{stat.ModTime(), stat.Size()}
+	}
+	t.mu.RLock()
+	changed := false
+	for i := range stamps {
+		if i >= len(t.stamps) || !stamps[i].modtime.Equal(t.stamps[i].modtime) || stamps[i].size != t.stamps[i].size {
+			changed = true
+		}
+	}
+	t.mu.RUnlock()
+	if !changed {
+		return nil
+	}
+	cert, err := tls.LoadX509KeyPair(t.cert, t.key)
+	if err != nil {
+		return err
+	}
+	config := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{"h2", "http/1.1"},
+	}
+	if t.clientCA != "" {
+		b, err := ioutil.ReadFile(t.clientCA)
+		if err != nil {
+			return err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(b) {
+			return fmt.Errorf("no certificates in client CA file %s", t.clientCA)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	t.mu.Lock()
+	t.config, t.stamps = config, stamps
+	t.mu.Unlock()
+	return nil
+}
+
+// watch reloads the files when they change, until quit is closed.
+// Files that fail to load, e.g. a certificate written before its key,
+// are logged and the previous ones are kept.
+func (t *tlsFiles) watch(quit <-chan struct{}) {
+	ticker := time.NewTicker(t.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := t.load(); err != nil {
+				log.Println("TLS certificates not reloaded:", err)
+			}
+		case <-quit:
+			return
+		}
+	}
+}
+
+func (t *tlsFiles) getConfigForClient(*tls.ClientHelloInfo) (*tls.Config, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.config, nil
+}
+
+func (t *tlsFiles) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return &t.config.Certificates[0], nil
+}
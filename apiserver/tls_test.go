@@ -0,0 +1,255 @@
+// Copyright 2009 The freegeoip authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package apiserver
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCA is a certificate authority generated at test time.
+type testCA struct {
+	cert   *x509.Certificate
+	key    *ecdsa.PrivateKey
+	pem    []byte
+	serial int64
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	ca := &testCA{}
+	ca.cert, ca.key, ca.pem = ca.issue(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "freegeoip test CA"},
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	})
+	return ca
+}
+
+// issue returns a certificate of the template signed by the CA, or
+// self-signed if the CA has no certificate yet, its key, and the
+// certificate in PEM.
+func (ca *testCA) issue(t *testing.T, template *x509.Certificate) (*x509.Certificate, *ecdsa.PrivateKey, []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca.serial++
+	template.SerialNumber = big.NewInt(ca.serial)
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	parent, signer := template, key
+	if ca.cert != nil {
+		parent, signer = ca.cert, ca.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+// writeServerCert writes a certificate for 127.0.0.1 and its key, and
+// returns its serial number.
+func (ca *testCA) writeServerCert(t *testing.T, certFile, keyFile string) int64 {
+	t.Helper()
+	cert, key, certPEM := ca.issue(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1)},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+	b, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: b}))
+	writeFile(t, certFile, certPEM)
+	return cert.SerialNumber.Int64()
+}
+
+func (ca *testCA) clientCert(t *testing.T) tls.Certificate {
+	t.Helper()
+	cert, key, _ := ca.issue(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "client"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	return tls.Certificate{Certificate: [][]byte{cert.Raw}, PrivateKey: key}
+}
+
+func writeFile(t *testing.T, name string, b []byte) {
+	t.Helper()
+	if err := ioutil.WriteFile(name+".tmp", b, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(name+".tmp", name); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// startTLSServer serves the HTTPS server of c on a local port and
+// returns its address.
+func startTLSServer(t *testing.T, c *Config) string {
+	t.Helper()
+	f, err := openHandler(t, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	servers, err := newServers(c, f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := servers[len(servers)-1]
+	if s.TLSConfig == nil {
+		t.Fatal("No HTTPS server")
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.ServeTLS(ln, "", "")
+	t.Cleanup(func() { s.Close() })
+	return ln.Addr().String()
+}
+
+func newTLSClient(ca *testCA, certs ...tls.Certificate) *http.Client {
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	return &http.Client{Transport: &http.Transport{
+		TLSClientConfig:   &tls.Config{RootCAs: roots, Certificates: certs},
+		ForceAttemptHTTP2: true,
+	}}
+}
+
+func TestTLS(t *testing.T) {
+	defer func(d time.Duration) { tlsReloadInterval = d }(tlsReloadInterval)
+	tlsReloadInterval = 10 * time.Millisecond
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	c := newTestConfig(t)
+	c.TLSCertFile, c.TLSKeyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	serial := ca.writeServerCert(t, c.TLSCertFile, c.TLSKeyFile)
+	addr := startTLSServer(t, c)
+
+	// get returns the serial number of the server certificate.
+	get := func() int64 {
+		t.Helper()
+		client := newTLSClient(ca)
+		defer client.CloseIdleConnections()
+		resp, err := client.Get("https://" + addr + "/json/8.8.8.8")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("Unexpected response: %s", resp.Status)
+		}
+		if resp.ProtoMajor != 2 {
+			t.Errorf("Unexpected protocol: %s", resp.Proto)
+		}
+		return resp.TLS.PeerCertificates[0].SerialNumber.Int64()
+	}
+	if v := get(); v != serial {
+		t.Fatalf("Unexpected certificate: %d, want %d", v, serial)
+	}
+
+	// A mismatched key is ignored until the certificate is rotated too.
+	_, key, _ := ca.issue(t, &x509.Certificate{})
+	b, _ := x509.MarshalECPrivateKey(key)
+	writeFile(t, c.TLSKeyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: b}))
+	time.Sleep(50 * time.Millisecond)
+	if v := get(); v != serial {
+		t.Fatalf("Unexpected certificate after an invalid rotation: %d, want %d", v, serial)
+	}
+
+	serial = ca.writeServerCert(t, c.TLSCertFile, c.TLSKeyFile)
+	deadline := time.Now().Add(5 * time.Second)
+	for get() != serial {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for the certificate to be reloaded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestTLSClientCA(t *testing.T) {
+	dir := t.TempDir()
+	ca, other := newTestCA(t), newTestCA(t)
+	c := newTestConfig(t)
+	c.TLSCertFile, c.TLSKeyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	c.TLSClientCAFile = filepath.Join(dir, "ca.pem")
+	ca.writeServerCert(t, c.TLSCertFile, c.TLSKeyFile)
+	writeFile(t, c.TLSClientCAFile, ca.pem)
+	addr := startTLSServer(t, c)
+	for _, tc := range []struct {
+		name  string
+		certs []tls.Certificate
+		ok    bool
+	}{
+		{"no certificate", nil, false},
+		{"unknown CA", []tls.Certificate{other.clientCert(t)}, false},
+		{"client CA", []tls.Certificate{ca.clientCert(t)}, true},
+	} {
+		resp, err := newTLSClient(ca, tc.certs...).Get("https://" + addr + "/json/8.8.8.8")
+		if err == nil {
+			resp.Body.Close()
+		}
+		if ok := err == nil && resp.StatusCode == http.StatusOK; ok != tc.ok {
+			t.Errorf("%s: unexpected result: %v", tc.name, err)
+		}
+	}
+}
+
+func TestTLSConfig(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	cert, key := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	ca.writeServerCert(t, cert, key)
+	for _, tc := range []struct {
+		cert, key, clientCA string
+		servers             int
+		ok                  bool
+	}{
+		{"", "", "", 1, true},
+		{cert, key, "", 2, true},
+		{cert, "", "", 0, false},
+		{"", "", cert, 0, false},
+		{cert, key, filepath.Join(dir, "missing.pem"), 0, false},
+		{cert, key, key, 0, false}, // No certificates.
+	} {
+		c := NewConfig()
+		c.TLSCertFile, c.TLSKeyFile, c.TLSClientCAFile = tc.cert, tc.key, tc.clientCA
+		servers, err := newServers(c, http.NotFoundHandler())
+		if (err == nil) != tc.ok || len(servers) != tc.servers {
+			t.Errorf("%+v: unexpected result: %d servers, %v", tc, len(servers), err)
+		}
+	}
+
+	// -port 0 disables HTTP with HTTPS.
+	c := NewConfig()
+	c.Port, c.TLSCertFile, c.TLSKeyFile = 0, cert, key
+	servers, err := newServers(c, http.NotFoundHandler())
+	if err != nil || len(servers) != 1 || servers[0].Addr != ":8443" {
+		t.Errorf("Unexpected servers: %v %v", servers, err)
+	}
+}
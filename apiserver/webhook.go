@@ -0,0 +1,124 @@
+// Copyright 2009 The freegeoip authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package apiserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// Delivery settings of webhooks, variables for the tests.
+var (
+	webhookQueueSize = 64
+	webhookRetries   = 5
+	webhookBackoff   = time.Second // Doubles after every attempt.
+	webhookTimeout   = 10 * time.Second
+)
+
+// webhook is an event sink that POSTs events as JSON to a URL. Events
+// are delivered in order by a single goroutine, and dropped when the
+// queue is full or after all retries failed.
+type webhook struct {
+	url    string
+	client *http.Client
+	queue  chan *dbEvent
+	quit   chan struct{}
+	once   sync.Once
+	done   chan struct{}
+}
+
+func newWebhook(rawurl string) (*webhook, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid webhook URL: %q", rawurl)
+	}
+	w := &webhook{
+		url:    rawurl,
+		client: &http.Client{Timeout: webhookTimeout},
+		queue:  make(chan *dbEvent, webhookQueueSize),
+		quit:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	go w.run()
+	return w, nil
+}
+
+func (w *webhook) send(e *dbEvent) {
+	select {
+	case w.queue <- e:
+	default:
+		log.Printf("webhook queue full, dropping %s event", e.Type)
+	}
+}
+
+// close stops the delivery. Queued events are delivered first, unless
+// they are still failing.
+func (w *webhook) close() {
+	w.once.Do(func() { close(w.quit) })
+}
+
+func (w *webhook) run() {
+	defer close(w.done)
+	for {
+		select {
+		case e := <-w.queue:
+			w.deliver(e)
+		case <-w.quit:
+			for {
+				select {
+				case e := <-w.queue:
+					w.deliver(e)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (w *webhook) deliver(e *dbEvent) {
+	b, err := json.Marshal(e)
+	if err != nil {
+		log.Println("webhook:", err)
+		return
+	}
+	backoff := webhookBackoff
+	for attempt := 0; ; attempt++ {
+		err = w.post(b)
+		if err == nil {
+			return
+		}
+		if attempt == webhookRetries {
+			break
+		}
+		select {
+		case <-time.After(backoff):
+			backoff *= 2
+		case <-w.quit:
+			// Shutting down, don't wait for a broken receiver.
+			log.Printf("webhook: dropping %s event: %v", e.Type, err)
+			return
+		}
+	}
+	log.Printf("webhook: dropping %s event after %d attempts: %v", e.Type, webhookRetries+1, err)
+}
+
+func (w *webhook) post(b []byte) error {
+	resp, err := w.client.Post(w.url, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+	return nil
+}
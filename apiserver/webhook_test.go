@@ -0,0 +1,94 @@
+// Copyright 2009 The freegeoip authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package apiserver
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/fiorix/freegeoip/internal/testdb"
+)
+
+func TestWebhook(t *testing.T) {
+	defer func(d time.Duration) { webhookBackoff = d }(webhookBackoff)
+	webhookBackoff = 10 * time.Millisecond
+
+	events := make(chan *dbEvent, 1)
+	var attempts int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&attempts, 1) == 1 {
+			http.Error(w, "try again", http.StatusInternalServerError)
+			return
+		}
+		var e dbEvent
+		if err := json.NewDecoder(r.Body).Decode(&e); err != nil {
+			t.Error(err)
+		}
+		events <- &e
+	}))
+	defer srv.Close()
+
+	c := newTestConfig(t)
+	c.WebhookURL = srv.URL
+	c.InstanceID = "test-1"
+	if _, err := openHandler(t, c); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case e := <-events:
+		want := testdb.BuildDate.Format(time.RFC3339)
+		if e.Type != eventLoaded || e.Instance != "test-1" || e.File != c.DB ||
+			e.Checksum == "" || e.BuildDate != want {
+			t.Fatalf("Unexpected event: %+v", e)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out")
+	}
+	if n := atomic.LoadInt32(&attempts); n != 2 {
+		t.Fatalf("Unexpected number of attempts: %d", n)
+	}
+}
+
+func TestWebhookQueueFull(t *testing.T) {
+	defer func(n int) { webhookQueueSize = n }(webhookQueueSize)
+	webhookQueueSize = 1
+
+	block := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-block
+	}))
+	defer srv.Close()
+	defer close(block)
+
+	w, err := newWebhook(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.close()
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 10; i++ {
+			w.send(&dbEvent{Type: eventStale})
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Sending to a full queue blocked")
+	}
+}
+
+func TestWebhookInvalidURL(t *testing.T) {
+	c := newTestConfig(t)
+	c.WebhookURL = "localhost:8080/hook"
+	if _, err := openHandler(t, c); err == nil {
+		t.Fatal("Unexpected handler with an invalid webhook URL")
+	}
+}
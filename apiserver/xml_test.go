@@ -0,0 +1,102 @@
+// Copyright 2009 The freegeoip authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package apiserver
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "update the golden files in testdata")
+
+// checkGolden compares output with the golden file testdata/name.
+func checkGolden(t *testing.T, name string, output []byte) {
+	t.Helper()
+	golden := filepath.Join("testdata", name)
+	if *update {
+		if err := ioutil.WriteFile(golden, output, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := ioutil.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(output, want) {
+		t.Errorf("%s: output does not match the golden file:\nhave:\n%s\nwant:\n%s", name, output, want)
+	}
+}
+
+func TestXML(t *testing.T) {
+	f, err := newTestHandler(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		path, accept, golden string
+	}{
+		{"/xml/8.8.8.8", "", "ipv4.xml"},
+		{"/xml/2a01:4f8::1", "", "ipv6.xml"},
+		{"/xml/10.0.0.1", "", "private.xml"},
+		{"/json/8.8.8.8", "application/xml", "ipv4.xml"},
+		{"/json/8.8.8.8", "text/xml, application/json;q=0.5", "ipv4.xml"},
+	} {
+		r := httptest.NewRequest("GET", tc.path, nil)
+		if tc.accept != "" {
+			r.Header.Set("Accept", tc.accept)
+		}
+		w := httptest.NewRecorder()
+		f.ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: unexpected response: %d %s", tc.path, w.Code, w.Body.String())
+		}
+		if ct := w.Header().Get("Content-Type"); ct != "application/xml" {
+			t.Errorf("%s: unexpected content type: %q", tc.path, ct)
+		}
+		checkGolden(t, tc.golden, w.Body.Bytes())
+	}
+}
+
+func TestPrefersXML(t *testing.T) {
+	for accept, want := range map[string]bool{
+		"":                                  false,
+		"*/*":                               false,
+		"application/json":                  false,
+		"application/xml":                   true,
+		"text/xml":                          true,
+		"application/json, application/xml": false,
+		"application/xml, application/json;q=0.9":     true,
+		"application/*;q=0.5, text/xml":               true,
+		"application/xml;q=0.1, */*":                  false,
+		"text/html, application/xhtml+xml, */*;q=0.8": false,
+		// Chrome and Firefox.
+		"text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8":                       false,
+		"text/html,application/xhtml+xml,application/xml;q=0.9,image/avif,image/webp,*/*;q=0.8": false,
+		"application/xml, */*;q=0": true,
+	} {
+		if have := prefersXML(accept); have != want {
+			t.Errorf("%q: have %v, want %v", accept, have, want)
+		}
+	}
+}
+
+func TestJSONFromBrowser(t *testing.T) {
+	f, err := newTestHandler(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("GET", "/json/8.8.8.8", nil)
+	r.Header.Set("Accept", "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8")
+	w := httptest.NewRecorder()
+	f.ServeHTTP(w, r)
+	if ct := w.Header().Get("Content-Type"); w.Code != http.StatusOK || ct != "application/json" {
+		t.Fatalf("Unexpected response: %d %q", w.Code, ct)
+	}
+}
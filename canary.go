@@ -0,0 +1,192 @@
+// Copyright 2009 The freegeoip authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package freegeoip
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// Probe is an address and the country it is expected to be located in.
+type Probe struct {
+	IP      net.IP
+	Country string // ISO 3166-1 alpha-2 code.
+}
+
+// ParseProbes parses a comma separated list of probes in the form
+// ip=country, e.g. "8.8.8.8=US,1.1.1.1=AU".
+func ParseProbes(s string) ([]Probe, error) {
+	var probes []Probe
+	for _, v := range strings.Split(s, ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		ip, country, ok := strings.Cut(v, "=")
+		addr := net.ParseIP(strings.TrimSpace(ip))
+		if !ok || addr == nil || strings.TrimSpace(country) == "" {
+			return nil, fmt.Errorf("invalid probe %q, want ip=country", v)
+		}
+		probes = append(probes, Probe{
+			IP:      addr,
+			Country: strings.ToUpper(strings.TrimSpace(country)),
+		})
+	}
+	return probes, nil
+}
+
+// canary validates new database builds before they replace the
+// current one.
+type canary struct {
+	probes    []Probe
+	maxChange float64
+}
+
+// Number of addresses compared between the current and the new build
+// to compute the change ratio.
+const canarySamples = 4096
+
+// WithCanary validates every new database build before it replaces the
+// current one, whether downloaded by OpenURL or dropped in for Open.
+//
+// All probes must be located in their expected country, and the ratio
+// of a deterministic sample of addresses whose country changed from the
+// current build must not exceed maxChange. Zero disables the ratio.
+//
+// Builds that fail are moved to the database file name with the
+// .quarantine suffix, the current build is kept and a ValidationError is
+// sent to NotifyError. The first build loaded has no current build to
+// be compared with, but it must pass the probes or Open fails. It is
+// left in place, since it is the only database.
+func WithCanary(probes []Probe, maxChange float64) Option {
+	return func(db *DB) {
+		db.canary = &canary{probes: probes, maxChange: maxChange}
+	}
+}
+
+// ValidationError is the error of a database build that failed the
+// canary validation, see WithCanary.
+type ValidationError struct {
+	File       string // Quarantined file, empty if it couldn't be moved.
+	Reason     string
+	Quarantine error // Error moving the file to quarantine, if any.
+}
+
+func (e *ValidationError) Error() string {
+	msg := "database failed validation: " + e.Reason
+	if e.File != "" {
+		msg += ", quarantined to " + e.File
+	}
+	if e.Quarantine != nil {
+		msg += fmt.Sprintf(", quarantine failed: %v", e.Quarantine)
+	}
+	return msg
+}
+
+// validate returns the reason the candidate build fails the canary
+// validation against the current one, which may be nil.
+func (c *canary) validate(current, candidate reader) string {
+	var q countryQuery
+	for _, p := range c.probes {
+		q.Country.ISOCode = ""
+		if err := candidate.Lookup(p.IP, &q); err != nil {
+			return fmt.Sprintf("lookup of probe %s: %v", p.IP, err)
+		}
+		if q.Country.ISOCode != p.Country {
+			return fmt.Sprintf("probe %s is in %q, want %q", p.IP, q.Country.ISOCode, p.Country)
+		}
+	}
+	if current == nil || c.maxChange <= 0 {
+		return ""
+	}
+	var compared, changed int
+	var a, b countryQuery
+	for _, ip := range canarySample() {
+		a.Country.ISOCode, b.Country.ISOCode = "", ""
+		if err := current.Lookup(ip, &a); err != nil {
+			continue
+		}
+		if err := candidate.Lookup(ip, &b); err != nil {
+			return fmt.Sprintf("lookup of %s: %v", ip, err)
+		}
+		if a.Country.ISOCode == "" && b.Country.ISOCode == "" {
+			continue
+		}
+		compared++
+		if a.Country.ISOCode != b.Country.ISOCode {
+			changed++
+		}
+	}
+	if compared == 0 {
+		return ""
+	}
+	if ratio := float64(changed) / float64(compared); ratio > c.maxChange {
+		return fmt.Sprintf("country changed for %.1f%% of sampled addresses, max %.1f%%",
+			100*ratio, 100*c.maxChange)
+	}
+	return ""
+}
+
+type countryQuery struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+}
+
+// canarySample returns the same public IPv4 addresses on every call,
+// spread over the address space.
+func canarySample() []net.IP {
+	ips := make([]net.IP, 0, canarySamples)
+	x := uint32(0x9e3779b9)
+	for len(ips) < canarySamples {
+		x ^= x << 13 // xorshift32
+		x ^= x >> 17
+		x ^= x << 5
+		ip := make(net.IP, net.IPv4len)
+		binary.BigEndian.PutUint32(ip, x)
+		if !Classify(ip).Reserved() {
+			ips = append(ips, ip)
+		}
+	}
+	return ips
+}
+
+// validate checks a candidate build read from file against the current
+// one, unless it was already validated as a download. Builds that fail
+// are moved to quarantine next to the database file if quarantine is
+// set, and a *ValidationError is returned.
+func (db *DB) validate(candidate reader, checksum, file string, quarantine bool) error {
+	if db.canary == nil {
+		return nil
+	}
+	db.mu.RLock()
+	done := checksum != "" && checksum == db.validated
+	reason := ""
+	if !done {
+		reason = db.canary.validate(db.reader, candidate)
+	}
+	db.mu.RUnlock()
+	if done {
+		db.mu.Lock()
+		db.validated = ""
+		db.mu.Unlock()
+		return nil
+	}
+	if reason == "" {
+		return nil
+	}
+	if !quarantine {
+		return &ValidationError{Reason: reason}
+	}
+	dst := db.file + ".quarantine"
+	err := os.Rename(file, dst)
+	if err != nil {
+		return &ValidationError{Reason: reason, Quarantine: err}
+	}
+	return &ValidationError{File: dst, Reason: reason}
+}
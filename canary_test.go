@@ -0,0 +1,241 @@
+// Copyright 2009 The freegeoip authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package freegeoip
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fiorix/freegeoip/dbbuild"
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// buildCountries returns a database with the given networks located in
+// countries.
+func buildCountries(t *testing.T, countries map[string]string) []byte {
+	t.Helper()
+	w := dbbuild.NewWriter(dbbuild.Metadata{
+		DatabaseType: "Test-Country",
+		Description:  map[string]string{"en": "Test database"},
+		BuildEpoch:   time.Date(2022, 5, 1, 0, 0, 0, 0, time.UTC),
+	})
+	for cidr, country := range countries {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		loc := dbbuild.Location{CountryCode: country}
+		if err = w.Insert(network, loc.Record()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var b bytes.Buffer
+	if _, err := w.WriteTo(&b); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func openCountries(t *testing.T, countries map[string]string) reader {
+	t.Helper()
+	r, err := maxminddb.FromBytes(buildCountries(t, countries))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return mmdbReader{r}
+}
+
+func writeCountries(t *testing.T, file string, countries map[string]string) {
+	t.Helper()
+	var b bytes.Buffer
+	gz := gzip.NewWriter(&b)
+	gz.Write(buildCountries(t, countries))
+	gz.Close()
+	// Write and rename, so watchers don't see a partial file.
+	err := ioutil.WriteFile(file+".tmp", b.Bytes(), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Rename(file+".tmp", file); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestParseProbes(t *testing.T) {
+	probes, err := ParseProbes(" 8.8.8.8=US, 2a01:4f8::1=de ,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(probes) != 2 ||
+		!probes[0].IP.Equal(net.ParseIP("8.8.8.8")) || probes[0].Country != "US" ||
+		!probes[1].IP.Equal(net.ParseIP("2a01:4f8::1")) || probes[1].Country != "DE" {
+		t.Fatalf("Unexpected probes: %v", probes)
+	}
+	for _, s := range []string{"8.8.8.8", "8.8.8.8=", "foo=US"} {
+		if _, err := ParseProbes(s); err == nil {
+			t.Errorf("Unexpected probes parsed from %q", s)
+		}
+	}
+}
+
+func TestCanaryChangeRatio(t *testing.T) {
+	current := openCountries(t, map[string]string{"0.0.0.0/1": "US", "128.0.0.0/1": "US"})
+	candidate := openCountries(t, map[string]string{"0.0.0.0/1": "US", "128.0.0.0/1": "DE"})
+	c := &canary{maxChange: 0.1}
+	if reason := c.validate(current, candidate); reason == "" {
+		t.Fatal("Unexpected candidate with half the countries changed passed")
+	}
+	c.maxChange = 0.6
+	if reason := c.validate(current, candidate); reason != "" {
+		t.Fatal("Unexpected failure:", reason)
+	}
+	if reason := c.validate(nil, candidate); reason != "" {
+		t.Fatal("Unexpected failure without a current build:", reason)
+	}
+}
+
+func TestCanaryOpen(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "db.gz")
+	writeCountries(t, file, map[string]string{"8.8.8.0/24": "DE"})
+	_, err := Open(file, WithCanary([]Probe{{net.ParseIP("8.8.8.8"), "US"}}, 0))
+	verr, ok := err.(*ValidationError)
+	if !ok {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	// The only database is not moved away.
+	if verr.File != "" {
+		t.Fatalf("Unexpected quarantine file: %q", verr.File)
+	}
+	if _, err = os.Stat(file); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(file + ".quarantine"); !os.IsNotExist(err) {
+		t.Fatalf("Unexpected quarantine: %v", err)
+	}
+}
+
+func TestCanaryURL(t *testing.T) {
+	var gzipped bytes.Buffer
+	gz := gzip.NewWriter(&gzipped)
+	gz.Write(buildCountries(t, map[string]string{"8.8.8.0/24": "US"}))
+	gz.Close()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(gzipped.Bytes())
+	}))
+	defer srv.Close()
+
+	// A local copy that fails the probes is replaced by a download.
+	file := filepath.Join(t.TempDir(), "db.gz")
+	writeCountries(t, file, map[string]string{"8.8.8.0/24": "DE"})
+	db, err := OpenURL(srv.URL, WithCacheFile(file),
+		WithCanary([]Probe{{net.ParseIP("8.8.8.8"), "US"}}, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for loaded := false; !loaded; {
+		select {
+		case <-db.NotifyOpen():
+			loaded = true
+		case <-db.NotifyInfo():
+		case err := <-db.NotifyError():
+			t.Fatal(err)
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timed out")
+		}
+	}
+	var q countryQuery
+	if err = db.Lookup(net.ParseIP("8.8.8.8"), &q); err != nil {
+		t.Fatal(err)
+	}
+	if q.Country.ISOCode != "US" {
+		t.Fatal("Unexpected country:", q.Country.ISOCode)
+	}
+	// The download was validated once, before it replaced the file.
+	db.mu.RLock()
+	validated := db.validated
+	db.mu.RUnlock()
+	if validated != "" {
+		t.Fatal("Download validated again when loaded")
+	}
+}
+
+func TestCanaryReload(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "db.gz")
+	writeCountries(t, file, map[string]string{"8.8.8.0/24": "US"})
+	db, err := Open(file, WithCanary([]Probe{{net.ParseIP("8.8.8.8"), "US"}}, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	<-db.NotifyOpen()
+
+	writeCountries(t, file, map[string]string{"8.8.8.0/24": "DE"})
+	select {
+	case err := <-db.NotifyError():
+		if _, ok := err.(*ValidationError); !ok {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	case <-db.NotifyOpen():
+		t.Fatal("Unexpected reload of a build that fails the probes")
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out")
+	}
+	if _, err = os.Stat(file + ".quarantine"); err != nil {
+		t.Fatal(err)
+	}
+	var q countryQuery
+	if err = db.Lookup(net.ParseIP("8.8.8.8"), &q); err != nil {
+		t.Fatal(err)
+	}
+	if q.Country.ISOCode != "US" {
+		t.Fatal("Unexpected country after a failed reload:", q.Country.ISOCode)
+	}
+}
+
+func TestCanaryReloadUnreadErrors(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "db.gz")
+	writeCountries(t, file, map[string]string{"8.8.8.0/24": "US"})
+	db, err := Open(file, WithCanary([]Probe{{net.ParseIP("8.8.8.8"), "US"}}, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	<-db.NotifyOpen()
+
+	// Nobody reads NotifyError, the second failure must not block.
+	for i, country := range []string{"DE", "FR"} {
+		writeCountries(t, file, map[string]string{"8.8.8.0/24": country})
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			if _, err = os.Stat(file + ".quarantine"); err == nil {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("Timed out waiting for failure %d", i)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		os.Remove(file + ".quarantine")
+	}
+	writeCountries(t, file, map[string]string{"8.8.8.0/24": "US", "8.8.4.0/24": "US"})
+	select {
+	case <-db.NotifyOpen():
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for a valid reload")
+	}
+	var q countryQuery
+	if err = db.Lookup(net.ParseIP("8.8.4.4"), &q); err != nil || q.Country.ISOCode != "US" {
+		t.Fatalf("Unexpected lookup: %v %q", err, q.Country.ISOCode)
+	}
+}
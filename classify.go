@@ -0,0 +1,116 @@
+// Copyright 2009 The freegeoip authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package freegeoip
+
+import "net"
+
+// Scope is the class of an IP address according to the IANA IPv4 and
+// IPv6 special-purpose address registries (RFC 6890 and updates).
+type Scope string
+
+// Scopes returned by Classify.
+const (
+	ScopeGlobal        Scope = "global"        // Globally routable unicast.
+	ScopePrivate       Scope = "private"       // RFC 1918 and unique-local.
+	ScopeLoopback      Scope = "loopback"      // 127.0.0.0/8 and ::1.
+	ScopeLinkLocal     Scope = "link-local"    // 169.254.0.0/16 and fe80::/10.
+	ScopeSharedAddress Scope = "cgnat"         // RFC 6598 shared address space.
+	ScopeDocumentation Scope = "documentation" // TEST-NET and 2001:db8::/32.
+	ScopeMulticast     Scope = "multicast"     // 224.0.0.0/4 and ff00::/8.
+	ScopeReserved      Scope = "reserved"      // Any other special-purpose block.
+)
+
+// Reserved reports whether the scope is a special-purpose block, for
+// which the database has no meaningful geolocation.
+func (s Scope) Reserved() bool {
+	return s != ScopeGlobal
+}
+
+type specialBlock struct {
+	net   *net.IPNet
+	scope Scope
+}
+
+// specialBlocks is checked in order, so more specific blocks must come
+// before any block that contains them. Blocks of the registries that
+// are globally reachable are listed as such before their parent.
+var specialBlocks = mustParseBlocks([]struct {
+	cidr  string
+	scope Scope
+}{
+	// IPv4, https://www.iana.org/assignments/iana-ipv4-special-registry
+	{"0.0.0.0/8", ScopeReserved},
+	{"10.0.0.0/8", ScopePrivate},
+	{"100.64.0.0/10", ScopeSharedAddress},
+	{"127.0.0.0/8", ScopeLoopback},
+	{"169.254.0.0/16", ScopeLinkLocal},
+	{"172.16.0.0/12", ScopePrivate},
+	{"192.0.0.9/32", ScopeGlobal},
+	{"192.0.0.10/32", ScopeGlobal},
+	{"192.0.0.0/24", ScopeReserved},
+	{"192.0.2.0/24", ScopeDocumentation},
+	{"192.88.99.0/24", ScopeReserved},
+	{"192.168.0.0/16", ScopePrivate},
+	{"198.18.0.0/15", ScopeReserved},
+	{"198.51.100.0/24", ScopeDocumentation},
+	{"203.0.113.0/24", ScopeDocumentation},
+	{"224.0.0.0/4", ScopeMulticast},
+	{"240.0.0.0/4", ScopeReserved}, // Includes 255.255.255.255.
+
+	// IPv6, https://www.iana.org/assignments/iana-ipv6-special-registry
+	{"::/128", ScopeReserved},
+	{"::1/128", ScopeLoopback},
+	{"64:ff9b:1::/48", ScopeReserved},
+	{"100::/64", ScopeReserved},
+	{"2001:1::1/128", ScopeGlobal},
+	{"2001:1::2/128", ScopeGlobal},
+	{"2001:3::/32", ScopeGlobal},
+	{"2001:4:112::/48", ScopeGlobal},
+	{"2001:20::/28", ScopeGlobal},
+	{"2001:db8::/32", ScopeDocumentation},
+	{"2001::/23", ScopeReserved},
+	{"3fff::/20", ScopeDocumentation},
+	{"5f00::/16", ScopeReserved},
+	{"fc00::/7", ScopePrivate},
+	{"fe80::/10", ScopeLinkLocal},
+	{"ff00::/8", ScopeMulticast},
+})
+
+func mustParseBlocks(list []struct {
+	cidr  string
+	scope Scope
+}) []specialBlock {
+	blocks := make([]specialBlock, len(list))
+	for i, b := range list {
+		_, n, err := net.ParseCIDR(b.cidr)
+		if err != nil {
+			panic(err)
+		}
+		blocks[i] = specialBlock{net: n, scope: b.scope}
+	}
+	return blocks
+}
+
+// Classify returns the scope of the given IP address. IPv4-mapped IPv6
+// addresses are classified as IPv4. Invalid addresses are reserved.
+func Classify(ip net.IP) Scope {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	} else if len(ip) != net.IPv6len {
+		return ScopeReserved
+	}
+	for _, b := range specialBlocks {
+		if len(b.net.IP) == len(ip) && b.net.Contains(ip) {
+			return b.scope
+		}
+	}
+	return ScopeGlobal
+}
+
+// Classify returns the scope of the given IP address. It does not
+// require the database to be loaded, see the Classify function.
+func (db *DB) Classify(ip net.IP) Scope {
+	return Classify(ip)
+}
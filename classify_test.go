@@ -0,0 +1,68 @@
+// Copyright 2009 The freegeoip authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package freegeoip
+
+import (
+	"net"
+	"testing"
+)
+
+func TestClassify(t *testing.T) {
+	for _, tc := range []struct {
+		ip    string
+		scope Scope
+	}{
+		{"8.8.8.8", ScopeGlobal},
+		{"10.0.0.1", ScopePrivate},
+		{"172.31.255.255", ScopePrivate},
+		{"172.32.0.1", ScopeGlobal},
+		{"192.168.1.1", ScopePrivate},
+		{"127.0.0.1", ScopeLoopback},
+		{"169.254.10.1", ScopeLinkLocal},
+		{"100.64.0.1", ScopeSharedAddress},
+		{"100.128.0.1", ScopeGlobal},
+		{"192.0.2.1", ScopeDocumentation},
+		{"198.51.100.7", ScopeDocumentation},
+		{"203.0.113.9", ScopeDocumentation},
+		{"224.0.0.251", ScopeMulticast},
+		{"255.255.255.255", ScopeReserved},
+		{"0.0.0.0", ScopeReserved},
+		{"::ffff:10.1.2.3", ScopePrivate},
+		{"::", ScopeReserved},
+		{"::1", ScopeLoopback},
+		{"fe80::1", ScopeLinkLocal},
+		{"fd00::1", ScopePrivate},
+		{"192.0.0.9", ScopeGlobal},
+		{"192.0.0.10", ScopeGlobal},
+		{"192.0.0.11", ScopeReserved},
+		{"2001:db8::1", ScopeDocumentation},
+		{"2001::1", ScopeReserved},
+		{"2001:1::1", ScopeGlobal},
+		{"2001:1::2", ScopeGlobal},
+		{"2001:1::3", ScopeReserved},
+		{"2001:3::1", ScopeGlobal},
+		{"2001:4:112::1", ScopeGlobal},
+		{"2001:4:113::1", ScopeReserved},
+		{"2001:20::1", ScopeGlobal},
+		{"2001:2f:ffff::1", ScopeGlobal},
+		{"2001:30::1", ScopeReserved},
+		{"64:ff9b:1::1", ScopeReserved},
+		{"64:ff9b::808:808", ScopeGlobal},
+		{"5f00::1", ScopeReserved},
+		{"2001:4860:4860::8888", ScopeGlobal},
+		{"ff02::1", ScopeMulticast},
+	} {
+		scope := Classify(net.ParseIP(tc.ip))
+		if scope != tc.scope {
+			t.Errorf("Classify(%s): want %q, have %q", tc.ip, tc.scope, scope)
+		}
+		if scope.Reserved() != (tc.scope != ScopeGlobal) {
+			t.Errorf("Classify(%s): unexpected reserved=%t", tc.ip, scope.Reserved())
+		}
+	}
+	if scope := Classify(nil); scope != ScopeReserved {
+		t.Errorf("Classify(nil): want %q, have %q", ScopeReserved, scope)
+	}
+}
@@ -0,0 +1,266 @@
+// Copyright 2009 The freegeoip authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/fiorix/freegeoip/dbbuild"
+	"github.com/fiorix/freegeoip/dbdiff"
+	"github.com/oschwald/maxminddb-golang"
+)
+
+const dbUsage = `Usage: freegeoip db <command> [flags] [args]
+
+Commands:
+  build   Compile CSV range files into a database
+  diff    Compare two builds of a database
+`
+
+// dbCommand runs the database management commands.
+func dbCommand(args []string) {
+	log.SetFlags(0)
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, dbUsage)
+		os.Exit(2)
+	}
+	var err error
+	switch args[0] {
+	case "build":
+		err = dbBuild(args[1:])
+	case "diff":
+		err = dbDiff(args[1:])
+	default:
+		fmt.Fprint(os.Stderr, dbUsage)
+		os.Exit(2)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func dbBuild(args []string) error {
+	fs := flag.NewFlagSet("db build", flag.ExitOnError)
+	output := fs.String("o", "db.gz", "Output file, gzipped if the name ends with .gz")
+	format := fs.String("format", string(dbbuild.FormatHeader), "Format of the range files: header or dbip")
+	locations := fs.String("locations", "", "Comma separated MaxMind locations files, one per language")
+	lang := fs.String("lang", "en", "Language of the names in the range files")
+	dbtype := fs.String("type", "freegeoip-City", "Database type stored in the metadata")
+	date := fs.String("date", "", "Build date as YYYY-MM-DD, for reproducible builds. Default now")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: freegeoip db build [flags] file.csv...\n\n")
+		fs.PrintDefaults()
+		fmt.Fprintf(os.Stderr, "\nColumns of header files: %s\n", strings.Join(dbbuild.Columns, ", "))
+	}
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	epoch := time.Now()
+	if *date != "" {
+		var err error
+		epoch, err = time.Parse("2006-01-02", *date)
+		if err != nil {
+			return fmt.Errorf("invalid date: %v", err)
+		}
+	}
+	w := dbbuild.NewWriter(dbbuild.Metadata{
+		DatabaseType: *dbtype,
+		Description:  map[string]string{"en": "Built by freegeoip from CSV sources"},
+		BuildEpoch:   epoch,
+	})
+	im := dbbuild.NewImporter(w, dbbuild.Format(*format), *lang)
+	if *locations != "" {
+		for _, name := range strings.Split(*locations, ",") {
+			err := readFile(name, im.ReadLocations)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	for _, name := range fs.Args() {
+		err := readFile(name, func(r io.Reader) error {
+			n, err := im.ReadRanges(r)
+			log.Printf("%s: %d ranges", name, n)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return writeFile(*output, w)
+}
+
+func dbDiff(args []string) error {
+	fs := flag.NewFlagSet("db diff", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "Print the report in JSON")
+	summary := fs.Bool("summary", false, "Only print the summary, not every changed network")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: freegeoip db diff [flags] old.mmdb.gz new.mmdb.gz\n\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	old, err := openMMDB(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	newer, err := openMMDB(fs.Arg(1))
+	if err != nil {
+		return err
+	}
+	var changes []*dbdiff.Change
+	report, err := dbdiff.Compare(old, newer, func(c *dbdiff.Change) {
+		switch {
+		case *summary:
+		case *asJSON:
+			changes = append(changes, c)
+		default:
+			printChange(os.Stdout, c)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		report.Changes = changes
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(report)
+	}
+	if !*summary && report.Added+report.Removed+report.Changed > 0 {
+		fmt.Println()
+	}
+	printReport(os.Stdout, report)
+	return nil
+}
+
+func printChange(w io.Writer, c *dbdiff.Change) {
+	location := func(l *dbdiff.Location) string {
+		s := l.CountryCode
+		if s == "" {
+			s = dbdiff.Unknown
+		}
+		for _, v := range []string{l.RegionCode, l.City} {
+			if v != "" {
+				s += "/" + v
+			}
+		}
+		return s
+	}
+	switch c.Kind {
+	case dbdiff.Added:
+		fmt.Fprintf(w, "+ %s %s\n", c.Network, location(c.New))
+	case dbdiff.Removed:
+		fmt.Fprintf(w, "- %s %s\n", c.Network, location(c.Old))
+	case dbdiff.Changed:
+		fmt.Fprintf(w, "~ %s %s -> %s (%s)\n", c.Network,
+			location(c.Old), location(c.New), strings.Join(c.Fields, ", "))
+	}
+}
+
+func printReport(w io.Writer, r *dbdiff.Report) {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "country\tadded\tremoved\tchanged\tmoved in\tmoved out\t")
+	row := func(name string, s *dbdiff.Summary) {
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%d\t%d\t\n",
+			name, s.Added, s.Removed, s.Changed, s.MovedIn, s.MovedOut)
+	}
+	codes := make([]string, 0, len(r.Countries))
+	for code := range r.Countries {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+	for _, code := range codes {
+		row(code, r.Countries[code])
+	}
+	row("total", &r.Summary)
+	tw.Flush()
+	if len(r.Fields) > 0 {
+		fmt.Fprintln(w)
+		for _, f := range dbdiff.Fields {
+			if n, ok := r.Fields[f]; ok {
+				fmt.Fprintf(w, "%s changed in %d networks\n", f, n)
+			}
+		}
+	}
+}
+
+// openMMDB opens a MaxMind DB file, gzipped or not.
+func openMMDB(name string) (*maxminddb.Reader, error) {
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) > 2 && b[0] == 0x1f && b[1] == 0x8b {
+		gz, err := gzip.NewReader(bytes.NewReader(b))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		b, err = ioutil.ReadAll(gz)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+	}
+	r, err := maxminddb.FromBytes(b)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	return r, nil
+}
+
+func readFile(name string, read func(io.Reader) error) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	err = read(f)
+	if err != nil {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	return nil
+}
+
+func writeFile(name string, w io.WriterTo) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	out := io.Writer(f)
+	var gz *gzip.Writer
+	if strings.HasSuffix(name, ".gz") {
+		gz = gzip.NewWriter(f)
+		out = gz
+	}
+	_, err = w.WriteTo(out)
+	if err != nil {
+		return err
+	}
+	if gz != nil {
+		err = gz.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return f.Close()
+}
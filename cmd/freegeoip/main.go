@@ -4,8 +4,16 @@
 
 package main
 
-import "github.com/fiorix/freegeoip/apiserver"
+import (
+	"os"
+
+	"github.com/fiorix/freegeoip/apiserver"
+)
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "db" {
+		dbCommand(os.Args[2:])
+		return
+	}
 	apiserver.Run()
 }
@@ -18,7 +18,6 @@ import (
 	"sync"
 	"time"
 
-	"github.com/fsnotify/fsnotify"
 	"github.com/oschwald/maxminddb-golang"
 )
 
@@ -31,29 +30,52 @@ var (
 	// Local cached copy of a database downloaded from a URL.
 	defaultDB = "./db.gz"
 
+	// Maximum time to download the database from its URL, so that a
+	// stuck download doesn't block updates forever.
+	downloadTimeout = 10 * time.Minute
+
 	// This URL is outdated and should only be used as fallback
 	MaxMindDBURL = "https://download.db-ip.com/free/dbip-city-lite-2022-04.mmdb.gz"
 )
 
+// Option configures optional behaviour of a DB created by Open or OpenURL.
+type Option func(*DB)
+
 // DB is the IP geolocation database.
 type DB struct {
-	file        string            // Database file name.
-	checksum    string            // MD5 of the unzipped database file
-	reader      *maxminddb.Reader // Actual db object.
-	notifyQuit  chan struct{}     // Stop auto-update and watch goroutines.
-	notifyOpen  chan string       // Notify when a db file is open.
-	notifyError chan error        // Notify when an error occurs.
-	notifyInfo  chan string       // Notify random actions for logging
-	closed      bool              // Mark this db as closed.
-	lastUpdated time.Time         // Last time the db was updated.
-	mu          sync.RWMutex      // Protects all the above.
+	file        string        // Database file name.
+	checksum    string        // MD5 of the unzipped database file
+	reader      reader        // Actual db object.
+	notifyQuit  chan struct{} // Stop auto-update and watch goroutines.
+	notifyOpen  chan string   // Notify when a db file is open.
+	notifyError chan error    // Notify when an error occurs.
+	notifyInfo  chan string   // Notify random actions for logging
+	closed      bool          // Mark this db as closed.
+	lastUpdated time.Time     // Last time the db was updated.
+	buildDate   time.Time     // Build epoch from the db metadata.
+	loaded      time.Time     // When the current build was loaded.
+	languages   []string      // Languages of the names in the db.
+	validated   string        // Checksum of a download that passed the canary.
+	mu          sync.RWMutex  // Protects all the above.
+
+	history      *history      // Previous builds, when enabled.
+	pollInterval time.Duration // Poll instead of using fsnotify, if set.
+	canary       *canary       // Validation of new builds, when enabled.
+	maxAge       time.Duration // Age of a stale database, if set.
+	staleCheck   chan struct{} // Check staleness after a load.
+	peers        []string      // URLs of sibling instances to download from.
+	peerSecret   string        // Sent to peers, if set.
+	cacheFile    string        // Local copy for OpenURL, if not defaultDB.
 }
 
 // Open creates and initializes a DB from a local file.
 //
 // The database file is monitored by fsnotify and automatically
-// reloads when the file is updated or overwritten.
-func Open(dsn string) (*DB, error) {
+// reloads when its content changes, either because the file is updated
+// or overwritten, or because a symlink in its path is swapped as with
+// Kubernetes volumes. If fsnotify is not available the file is polled
+// instead, see WithPolling.
+func Open(dsn string, opts ...Option) (*DB, error) {
 	db := &DB{
 		file:        dsn,
 		notifyQuit:  make(chan struct{}),
@@ -61,6 +83,9 @@ func Open(dsn string) (*DB, error) {
 		notifyError: make(chan error, 1),
 		notifyInfo:  make(chan string, 1),
 	}
+	for _, opt := range opts {
+		opt(db)
+	}
 	err := db.openFile()
 	if err != nil {
 		db.Close()
@@ -69,15 +94,19 @@ func Open(dsn string) (*DB, error) {
 	err = db.watchFile()
 	if err != nil {
 		db.Close()
-		return nil, fmt.Errorf("fsnotify failed for %s: %s", dsn, err)
+		return nil, fmt.Errorf("watch failed for %s: %s", dsn, err)
+	}
+	if db.maxAge > 0 {
+		go db.watchStale()
 	}
 	return db, nil
 }
 
 // OpenURL creates and initializes a DB from a URL.
 // It automatically downloads and updates the file in background, and
-// keeps a local copy on $TMPDIR.
-func OpenURL(url string) (*DB, error) {
+// keeps a local copy on $TMPDIR. See WithPeers to download from other
+// instances first.
+func OpenURL(url string, opts ...Option) (*DB, error) {
 	db := &DB{
 		file:        defaultDB,
 		notifyQuit:  make(chan struct{}),
@@ -85,46 +114,59 @@ func OpenURL(url string) (*DB, error) {
 		notifyError: make(chan error, 1),
 		notifyInfo:  make(chan string, 1),
 	}
-	db.openFile()
-	go db.tryUpdate(url)
+	for _, opt := range opts {
+		opt(db)
+	}
+	if db.cacheFile != "" {
+		db.file = db.cacheFile
+	}
+	// A local copy that fails validation is replaced by a download.
+	_, invalid := db.openFile().(*ValidationError)
+	go db.tryUpdate(url, invalid)
 	err := db.watchFile()
 	if err != nil {
 		db.Close()
-		return nil, fmt.Errorf("fsnotify failed for %s: %s", db.file, err)
+		return nil, fmt.Errorf("watch failed for %s: %s", db.file, err)
+	}
+	if db.maxAge > 0 {
+		go db.watchStale()
 	}
 	return db, nil
 }
 
 func (db *DB) watchFile() error {
-	watcher, err := fsnotify.NewWatcher()
-	if err != nil {
-		return err
-	}
 	dbdir, err := db.makeDir()
 	if err != nil {
 		return err
 	}
-	go db.watchEvents(watcher)
-	return watcher.Add(dbdir)
+	var w watcher
+	if db.pollInterval > 0 {
+		w = newPollWatcher(db.file, db.pollInterval)
+	} else {
+		w, err = newFSWatcher(db.file, dbdir)
+		if err != nil {
+			// Common on network filesystems and when inotify
+			// instances are exhausted, fall back to polling.
+			msg := fmt.Sprintf("fsnotify failed for %s, polling every %s: %s",
+				db.file, defaultPollInterval, err)
+			select {
+			case db.notifyInfo <- msg:
+			default: // Don't block Open if nobody is listening.
+			}
+			w = newPollWatcher(db.file, defaultPollInterval)
+		}
+	}
+	go db.watchEvents(w)
+	return nil
 }
 
-func (db *DB) watchEvents(watcher *fsnotify.Watcher) {
+func (db *DB) watchEvents(w watcher) {
+	defer w.Close()
 	for {
 		select {
-		case ev, ok := <-watcher.Events:
-			if !ok {
-				return
-			}
-			if ev.Name == db.file {
-				fmt.Println("event", ev)
-				if ev.Op&fsnotify.Write == fsnotify.Write || ev.Op&fsnotify.Create == fsnotify.Create {
-					db.openFile()
-				}
-			}
-		case <-watcher.Errors:
+		case <-w.Changes():
+			db.openFile()
 		case <-db.notifyQuit:
-			fmt.Println("error during watching")
-			watcher.Close()
 			return
 		}
 	}
@@ -137,13 +179,36 @@ func (db *DB) openFile() error {
 	}
 	stat, err := os.Stat(db.file)
 	if err != nil {
+		reader.Close()
 		return err
 	}
-	db.setReader(reader, stat.ModTime(), checksum)
+	db.mu.RLock()
+	current := db.reader != nil
+	db.mu.RUnlock()
+	// The first build is the only database, quarantine reloads only.
+	err = db.validate(reader, checksum, db.file, current)
+	if err != nil {
+		reader.Close()
+		if current {
+			// Reloads are not reported by the caller.
+			db.reportError(err)
+		}
+		return err
+	}
+	now := time.Now()
+	db.setReader(reader, stat.ModTime(), checksum, now)
+	if db.history != nil {
+		err = db.history.add(db.file, checksum, now, now)
+		if err != nil {
+			db.reportError(fmt.Errorf("failed to archive database: %v", err))
+		}
+	}
 	return nil
 }
 
-func (db *DB) newReader(dbfile string) (*maxminddb.Reader, string, error) {
+// newReader opens a gzipped database file. The format is detected from
+// its content, see the reader type for the supported ones.
+func (db *DB) newReader(dbfile string) (reader, string, error) {
 	f, err := os.Open(dbfile)
 	if err != nil {
 		return nil, "", err
@@ -159,11 +224,21 @@ func (db *DB) newReader(dbfile string) (*maxminddb.Reader, string, error) {
 		return nil, "", err
 	}
 	checksum := fmt.Sprintf("%x", md5.Sum(b))
+	if isIP2Location(b) {
+		bin, err := newIP2LocationReader(b)
+		if err != nil {
+			return nil, "", err
+		}
+		return bin, checksum, nil
+	}
 	mmdb, err := maxminddb.FromBytes(b)
-	return mmdb, checksum, err
+	if err != nil {
+		return nil, "", err
+	}
+	return mmdbReader{mmdb}, checksum, nil
 }
 
-func (db *DB) setReader(reader *maxminddb.Reader, modtime time.Time, checksum string) {
+func (db *DB) setReader(reader reader, modtime time.Time, checksum string, loaded time.Time) {
 	db.mu.Lock()
 	defer db.mu.Unlock()
 	if db.closed {
@@ -175,31 +250,51 @@ func (db *DB) setReader(reader *maxminddb.Reader, modtime time.Time, checksum st
 	}
 	db.reader = reader
 	db.lastUpdated = modtime.UTC()
+	db.buildDate = reader.buildDate()
+	db.loaded = loaded
+	db.languages = reader.languages()
 	db.checksum = checksum
+	if db.staleCheck != nil {
+		notify(db.staleCheck)
+	}
 	db.notifyOpen <- db.file
 }
 
-func (db *DB) tryUpdate(url string) {
+func (db *DB) tryUpdate(url string, force bool) {
 	db.sendInfo("starting update")
-	err := db.runUpdate(url)
-	if err != nil {
+	err := db.runUpdate(url, force)
+	if verr, ok := err.(*ValidationError); ok {
+		db.sendError(verr)
+	} else if err != nil {
 		db.sendError(fmt.Errorf("download failed"))
 	}
 	db.sendInfo("finished update")
 }
 
-func (db *DB) runUpdate(url string) error {
+// runUpdate downloads the database if needed, or always with force.
+func (db *DB) runUpdate(url string, force bool) error {
 	yes, err := db.needUpdate(url)
 	if err != nil {
 		return err
 	}
-	if !yes {
+	if !yes && !force {
 		db.sendInfo("no update needed")
 		return nil
 	}
-	db.sendInfo(fmt.Sprintf("downloading db from %s", url))
-	tmpfile, err := db.download(url)
+	var tmpfile string
+	if len(db.peers) > 0 {
+		tmpfile, err = db.downloadPeers()
+	}
+	if len(db.peers) == 0 || err != nil {
+		db.sendInfo(fmt.Sprintf("downloading db from %s", url))
+		tmpfile, err = db.download(url)
+	}
+	if err != nil {
+		return err
+	}
+	err = db.validateFile(tmpfile)
 	if err != nil {
+		os.RemoveAll(tmpfile) // Unless already in quarantine.
 		return err
 	}
 	err = db.renameFile(tmpfile)
@@ -210,6 +305,27 @@ func (db *DB) runUpdate(url string) error {
 	return err
 }
 
+// validateFile checks a downloaded file with the canary, if enabled,
+// before it replaces the database file. Files that pass are not
+// validated again when the database file is reloaded.
+func (db *DB) validateFile(name string) error {
+	if db.canary == nil {
+		return nil
+	}
+	reader, checksum, err := db.newReader(name)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	if err = db.validate(reader, "", name, true); err != nil {
+		return err
+	}
+	db.mu.Lock()
+	db.validated = checksum
+	db.mu.Unlock()
+	return nil
+}
+
 func (db *DB) needUpdate(url string) (bool, error) {
 	_, err := os.Stat(db.file)
 	if err != nil {
@@ -220,23 +336,39 @@ func (db *DB) needUpdate(url string) (bool, error) {
 }
 
 func (db *DB) download(url string) (tmpfile string, err error) {
-	resp, err := http.Get(url)
+	req, err := http.NewRequest(http.MethodGet, url, nil)
 	if err != nil {
 		return "", err
 	}
+	tmpfile, _, err = db.fetch(req, downloadTimeout)
+	return tmpfile, err
+}
+
+// fetch downloads the response of req to a temporary file within
+// timeout, and returns its name and the response headers.
+func (db *DB) fetch(req *http.Request, timeout time.Duration) (tmpfile string, header http.Header, err error) {
+	client := &http.Client{Timeout: timeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", nil, err
+	}
 	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", nil, fmt.Errorf("unexpected status: %s", resp.Status)
+	}
 	tmpfile = filepath.Join(os.TempDir(),
 		fmt.Sprintf("_freegeoip.%d.db.gz", time.Now().UnixNano()))
 	f, err := os.Create(tmpfile)
 	if err != nil {
-		return "", err
+		return "", nil, err
 	}
 	defer f.Close()
 	_, err = io.Copy(f, resp.Body)
 	if err != nil {
-		return "", err
+		os.Remove(tmpfile)
+		return "", nil, err
 	}
-	return tmpfile, nil
+	return tmpfile, resp.Header, nil
 }
 
 func (db *DB) makeDir() (dbdir string, err error) {
@@ -268,6 +400,35 @@ func (db *DB) Date() time.Time {
 	return db.lastUpdated
 }
 
+// BuildDate returns the UTC date the database was built, as recorded
+// in its metadata. It is zero if no database file has been opened.
+func (db *DB) BuildDate() time.Time {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.buildDate
+}
+
+// Languages returns the languages of the names in the database, as
+// listed in its metadata.
+func (db *DB) Languages() []string {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.languages
+}
+
+// File returns the name of the database file.
+func (db *DB) File() string {
+	return db.file
+}
+
+// Checksum returns the MD5 checksum of the unzipped database file, in
+// hex. It is empty if no database file has been opened.
+func (db *DB) Checksum() string {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.checksum
+}
+
 // NotifyClose returns a channel that is closed when the database is closed.
 func (db *DB) NotifyClose() <-chan struct{} {
 	return db.notifyQuit
@@ -281,7 +442,9 @@ func (db *DB) NotifyOpen() (filename <-chan string) {
 }
 
 // NotifyError returns a channel that notifies when an error occurs
-// while downloading or reloading a DB that points to a URL.
+// while downloading or reloading a DB that points to a URL. Failed
+// reloads of files, failed archives and stale databases are also
+// notified, but dropped while the previous error is not read.
 func (db *DB) NotifyError() (errChan <-chan error) {
 	return db.notifyError
 }
@@ -301,6 +464,21 @@ func (db *DB) sendError(err error) {
 	db.notifyError <- err
 }
 
+// reportError is like sendError for errors of background checks, but
+// drops err if the previous one was not read yet, so that the database
+// is not blocked when nobody reads NotifyError.
+func (db *DB) reportError(err error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.closed {
+		return
+	}
+	select {
+	case db.notifyError <- err:
+	default:
+	}
+}
+
 func (db *DB) sendInfo(message string) {
 	db.mu.RLock()
 	defer db.mu.RUnlock()
@@ -315,7 +493,8 @@ func (db *DB) sendInfo(message string) {
 // with specific fields and tags as described here:
 // https://godoc.org/github.com/oschwald/maxminddb-golang#Reader.Lookup
 //
-// See the DefaultQuery for an example of the result struct.
+// See the DefaultQuery for an example of the result struct. Databases
+// in the IP2Location BIN format are presented with the same layout.
 func (db *DB) Lookup(addr net.IP, result interface{}) error {
 	db.mu.RLock()
 	defer db.mu.RUnlock()
@@ -367,4 +546,7 @@ func (db *DB) Close() {
 		db.reader.Close()
 		db.reader = nil
 	}
+	if db.history != nil {
+		db.history.close()
+	}
 }
@@ -5,7 +5,9 @@
 package freegeoip
 
 import (
+	"bytes"
 	"errors"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"net/http/httptest"
@@ -13,23 +15,42 @@ import (
 	"path/filepath"
 	"testing"
 	"time"
+
+	"github.com/fiorix/freegeoip/internal/testdb"
 )
 
 var testFile = "testdata/db.gz"
 
-func TestDownload(t *testing.T) {
-	if _, err := os.Stat(testFile); err == nil {
-		t.Skip("Test database already exists:", testFile)
+func TestMain(m *testing.M) {
+	// The tests use a small generated database, see package
+	// freegeoiptest, so they don't need network access.
+	err := testdb.WriteFile(testFile)
+	if err != nil {
+		panic(err)
 	}
+	code := m.Run()
+	os.Remove(testFile)
+	os.Exit(code)
+}
+
+func TestDownload(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.Handle("/testdata/", http.FileServer(http.Dir(".")))
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
 	db := &DB{}
-	dbfile, err := db.download(MaxMindDBURL)
+	dbfile, err := db.download(srv.URL + "/" + testFile)
 	if err != nil {
 		t.Fatal(err)
 	}
-	err = os.Rename(dbfile, testFile)
+	defer os.Remove(dbfile)
+	b, err := ioutil.ReadFile(dbfile)
 	if err != nil {
 		t.Fatal(err)
 	}
+	if !bytes.Equal(b, testdb.Gzip()) {
+		t.Fatal("Downloaded file does not match the test database")
+	}
 }
 
 func TestNeedUpdateFileMissing(t *testing.T) {
@@ -184,7 +205,9 @@ func TestLookupOnURL(t *testing.T) {
 	mux.Handle("/testdata/", http.FileServer(http.Dir(".")))
 	srv := httptest.NewServer(mux)
 	defer srv.Close()
-	os.Remove(defaultDB) // In case it exists.
+	tmp := defaultDB
+	defaultDB = filepath.Join(t.TempDir(), "db.gz")
+	defer func() { defaultDB = tmp }()
 	db, err := OpenURL(srv.URL + "/" + testFile)
 	if err != nil {
 		t.Fatal(err)
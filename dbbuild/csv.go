@@ -0,0 +1,338 @@
+// Copyright 2009 The freegeoip authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package dbbuild
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Format is the column layout of a CSV range file.
+type Format string
+
+const (
+	// FormatHeader is a CSV file with a header row naming its
+	// columns, see Columns. The MaxMind GeoLite2 and GeoIP2 City CSV
+	// blocks files are in this format, and refer to the locations
+	// loaded by Importer.ReadLocations.
+	FormatHeader Format = "header"
+
+	// FormatDBIP is the headerless layout of the db-ip City Lite CSV.
+	FormatDBIP Format = "dbip"
+)
+
+// Columns lists the column names recognized in FormatHeader files. A
+// network column or both ip_start and ip_end are required, everything
+// else is optional. Alternative names used by MaxMind are accepted too.
+var Columns = []string{
+	"network",
+	"ip_start",
+	"ip_end",
+	"geoname_id",
+	"registered_country_geoname_id",
+	"continent_code",
+	"continent_name",
+	"country_code",
+	"country_name",
+	"region_code",
+	"region_name",
+	"city",
+	"postal_code",
+	"latitude",
+	"longitude",
+	"metro_code",
+	"time_zone",
+}
+
+var columnAliases = map[string]string{
+	"country_iso_code":       "country_code",
+	"subdivision_1_iso_code": "region_code",
+	"subdivision_1_name":     "region_name",
+	"city_name":              "city",
+	"zip_code":               "postal_code",
+}
+
+// dbipColumns is the layout of FormatDBIP files.
+var dbipColumns = []string{
+	"ip_start",
+	"ip_end",
+	"continent_code",
+	"country_code",
+	"region_name",
+	"city",
+	"latitude",
+	"longitude",
+}
+
+// Importer reads CSV sources and inserts their locations into a Writer.
+type Importer struct {
+	w         *Writer
+	format    Format
+	lang      string
+	locations map[string]*Location // By geoname_id.
+}
+
+// NewImporter creates and initializes a new Importer that writes to w.
+// Names in range files are stored under the given language code. The
+// languages of all names read are added to the metadata of w.
+func NewImporter(w *Writer, format Format, lang string) *Importer {
+	return &Importer{
+		w:         w,
+		format:    format,
+		lang:      lang,
+		locations: make(map[string]*Location),
+	}
+}
+
+func (im *Importer) addLanguage(lang string) {
+	for _, l := range im.w.meta.Languages {
+		if l == lang {
+			return
+		}
+	}
+	im.w.meta.Languages = append(im.w.meta.Languages, lang)
+}
+
+// ReadLocations reads a MaxMind City CSV locations file, referred to by
+// the geoname_id columns of range files. It may be called once for
+// every locale to collect the names in all languages.
+func (im *Importer) ReadLocations(r io.Reader) error {
+	cr := newCSVReader(r)
+	header, err := cr.Read()
+	if err != nil {
+		return fmt.Errorf("failed to read header: %v", err)
+	}
+	cols := columnIndex(header)
+	for line := 2; ; line++ {
+		row, err := cr.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		get := func(name string) string {
+			if i, ok := cols[name]; ok && i < len(row) {
+				return row[i]
+			}
+			return ""
+		}
+		id, lang := get("geoname_id"), get("locale_code")
+		if id == "" || lang == "" {
+			return fmt.Errorf("line %d: missing geoname_id or locale_code", line)
+		}
+		im.addLanguage(lang)
+		var subdivisions [][2]string
+		for _, c := range subdivisionColumns {
+			if code, name := get(c[0]), get(c[1]); code != "" || name != "" {
+				subdivisions = append(subdivisions, [2]string{code, name})
+			}
+		}
+		loc, ok := im.locations[id]
+		if !ok {
+			loc = &Location{
+				ContinentCode: get("continent_code"),
+				CountryCode:   get("country_code"),
+				TimeZone:      get("time_zone"),
+			}
+			for _, s := range subdivisions {
+				loc.Subdivisions = append(loc.Subdivisions, Subdivision{ISOCode: s[0]})
+			}
+			if v := get("metro_code"); v != "" {
+				mc, err := strconv.ParseUint(v, 10, 16)
+				if err != nil {
+					return fmt.Errorf("line %d: invalid metro_code: %v", line, err)
+				}
+				loc.MetroCode = uint16(mc)
+			}
+			im.locations[id] = loc
+		}
+		loc.ContinentNames = addName(loc.ContinentNames, lang, get("continent_name"))
+		loc.CountryNames = addName(loc.CountryNames, lang, get("country_name"))
+		loc.CityNames = addName(loc.CityNames, lang, get("city"))
+		for i, s := range subdivisions {
+			if i < len(loc.Subdivisions) {
+				loc.Subdivisions[i].Names = addName(loc.Subdivisions[i].Names, lang, s[1])
+			}
+		}
+	}
+}
+
+// subdivisionColumns are the code and name columns of the subdivisions
+// in MaxMind locations files, largest first.
+var subdivisionColumns = [][2]string{
+	{"region_code", "region_name"},
+	{"subdivision_2_iso_code", "subdivision_2_name"},
+}
+
+// ReadRanges reads a CSV range file and inserts a record for every row.
+// It returns the number of rows inserted.
+func (im *Importer) ReadRanges(r io.Reader) (int, error) {
+	cr := newCSVReader(r)
+	var cols map[string]int
+	line := 1
+	switch im.format {
+	case FormatDBIP:
+		cols = columnIndex(dbipColumns)
+	case FormatHeader, "":
+		header, err := cr.Read()
+		if err != nil {
+			return 0, fmt.Errorf("failed to read header: %v", err)
+		}
+		cols = columnIndex(header)
+		line++
+	default:
+		return 0, fmt.Errorf("unsupported format: %q", im.format)
+	}
+	im.addLanguage(im.lang)
+	_, hasNetwork := cols["network"]
+	_, hasStart := cols["ip_start"]
+	_, hasEnd := cols["ip_end"]
+	if !hasNetwork && !(hasStart && hasEnd) {
+		return 0, fmt.Errorf("missing network or ip_start and ip_end columns")
+	}
+	n := 0
+	for ; ; line++ {
+		row, err := cr.Read()
+		if err == io.EOF {
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+		err = im.insertRow(cols, row)
+		if err != nil {
+			return n, fmt.Errorf("line %d: %v", line, err)
+		}
+		n++
+	}
+}
+
+func (im *Importer) insertRow(cols map[string]int, row []string) error {
+	get := func(name string) string {
+		if i, ok := cols[name]; ok && i < len(row) {
+			return strings.TrimSpace(row[i])
+		}
+		return ""
+	}
+	var loc Location
+	id := get("geoname_id")
+	if id == "" {
+		id = get("registered_country_geoname_id")
+	}
+	if id != "" {
+		ref, ok := im.locations[id]
+		if !ok {
+			return fmt.Errorf("unknown geoname_id %s", id)
+		}
+		loc = *ref
+	}
+	setString(&loc.ContinentCode, get("continent_code"))
+	setString(&loc.CountryCode, get("country_code"))
+	setString(&loc.PostalCode, get("postal_code"))
+	setString(&loc.TimeZone, get("time_zone"))
+	if v := get("continent_name"); v != "" {
+		loc.ContinentNames = map[string]string{im.lang: v}
+	} else if v := continentNames[loc.ContinentCode]; v != "" && len(loc.ContinentNames) == 0 {
+		loc.ContinentNames = map[string]string{"en": v}
+	}
+	if v := get("country_name"); v != "" {
+		loc.CountryNames = map[string]string{im.lang: v}
+	}
+	if v := get("city"); v != "" {
+		loc.CityNames = map[string]string{im.lang: v}
+	}
+	if code, name := get("region_code"), get("region_name"); code != "" || name != "" {
+		s := Subdivision{ISOCode: code}
+		if name != "" {
+			s.Names = map[string]string{im.lang: name}
+		}
+		loc.Subdivisions = append([]Subdivision{s}, tail(loc.Subdivisions)...)
+	}
+	var err error
+	for _, f := range []struct {
+		name string
+		v    *float64
+	}{
+		{"latitude", &loc.Latitude},
+		{"longitude", &loc.Longitude},
+	} {
+		if s := get(f.name); s != "" {
+			*f.v, err = strconv.ParseFloat(s, 64)
+			if err != nil {
+				return fmt.Errorf("invalid %s: %v", f.name, err)
+			}
+		}
+	}
+	if s := get("metro_code"); s != "" {
+		mc, err := strconv.ParseUint(s, 10, 16)
+		if err != nil {
+			return fmt.Errorf("invalid metro_code: %v", err)
+		}
+		loc.MetroCode = uint16(mc)
+	}
+
+	if s := get("network"); s != "" {
+		_, network, err := net.ParseCIDR(s)
+		if err != nil {
+			return err
+		}
+		return im.w.Insert(network, loc.Record())
+	}
+	start, end := net.ParseIP(get("ip_start")), net.ParseIP(get("ip_end"))
+	if start == nil || end == nil {
+		return fmt.Errorf("invalid range: %q-%q", get("ip_start"), get("ip_end"))
+	}
+	return im.w.InsertRange(start, end, loc.Record())
+}
+
+func newCSVReader(r io.Reader) *csv.Reader {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	cr.ReuseRecord = true
+	return cr
+}
+
+func columnIndex(header []string) map[string]int {
+	cols := make(map[string]int, len(header))
+	for i, name := range header {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if alias, ok := columnAliases[name]; ok {
+			name = alias
+		}
+		cols[name] = i
+	}
+	return cols
+}
+
+func setString(dst *string, v string) {
+	if v != "" {
+		*dst = v
+	}
+}
+
+// addName returns names with the given translation added, creating the
+// map if needed. Empty names are ignored.
+func addName(names map[string]string, lang, name string) map[string]string {
+	if name == "" {
+		return names
+	}
+	if names == nil {
+		names = make(map[string]string)
+	}
+	names[lang] = name
+	return names
+}
+
+func tail(s []Subdivision) []Subdivision {
+	if len(s) == 0 {
+		return nil
+	}
+	return s[1:]
+}
@@ -0,0 +1,142 @@
+// Copyright 2009 The freegeoip authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package dbbuild
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/fiorix/freegeoip"
+)
+
+func newTestWriter() *Writer {
+	return NewWriter(Metadata{
+		DatabaseType: "Test-City",
+		Description:  map[string]string{"en": "Test"},
+		Languages:    []string{"en"},
+	})
+}
+
+func lookup(t *testing.T, w *Writer, ip string) freegeoip.DefaultQuery {
+	t.Helper()
+	reader := openWriter(t, w)
+	defer reader.Close()
+	var q freegeoip.DefaultQuery
+	if err := reader.Lookup(net.ParseIP(ip), &q); err != nil {
+		t.Fatal(err)
+	}
+	return q
+}
+
+func TestReadRangesDBIP(t *testing.T) {
+	w := newTestWriter()
+	im := NewImporter(w, FormatDBIP, "en")
+	n, err := im.ReadRanges(strings.NewReader(`1.0.0.0,1.0.0.255,OC,AU,Queensland,"South Brisbane",-27.4748,153.017
+200.1.2.0,200.1.2.255,SA,VE,"Distrito Federal",Caracas,10.5,-66.9167
+2001:db8::,2001:db8::ffff,EU,DE,Berlin,Berlin,52.5244,13.4105
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Fatal("Unexpected number of rows:", n)
+	}
+	q := lookup(t, w, "200.1.2.3")
+	if q.Country.ISOCode != "VE" ||
+		q.City.Names["en"] != "Caracas" ||
+		q.Continent.Names["en"] != "South America" ||
+		len(q.Region) != 1 || q.Region[0].Names["en"] != "Distrito Federal" ||
+		q.Location.Latitude != 10.5 {
+		t.Fatalf("Unexpected record: %#v", q)
+	}
+	if q := lookup(t, w, "2001:db8::1"); q.Country.ISOCode != "DE" {
+		t.Fatalf("Unexpected record: %#v", q)
+	}
+}
+
+func TestReadRangesHeader(t *testing.T) {
+	w := newTestWriter()
+	im := NewImporter(w, FormatHeader, "de")
+	_, err := im.ReadRanges(strings.NewReader(`network,country_code,country_name,city,zip_code
+10.0.0.0/8,DE,Deutschland,München,80331
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := lookup(t, w, "10.1.2.3")
+	if q.Country.Names["de"] != "Deutschland" || q.City.Names["de"] != "München" || q.Postal.Code != "80331" {
+		t.Fatalf("Unexpected record: %#v", q)
+	}
+}
+
+func TestReadRangesMaxMind(t *testing.T) {
+	w := newTestWriter()
+	im := NewImporter(w, FormatHeader, "en")
+	for _, locations := range []string{
+		`geoname_id,locale_code,continent_code,continent_name,country_iso_code,country_name,subdivision_1_iso_code,subdivision_1_name,subdivision_2_iso_code,subdivision_2_name,city_name,metro_code,time_zone,is_in_european_union
+2643743,en,EU,Europe,GB,"United Kingdom",ENG,England,,,London,,Europe/London,0
+2635167,en,EU,Europe,GB,"United Kingdom",,,,,,,Europe/London,0
+`,
+		`geoname_id,locale_code,continent_code,continent_name,country_iso_code,country_name,subdivision_1_iso_code,subdivision_1_name,subdivision_2_iso_code,subdivision_2_name,city_name,metro_code,time_zone,is_in_european_union
+2643743,de,EU,Europa,GB,"Vereinigtes Königreich",ENG,England,,,London,,Europe/London,0
+`,
+	} {
+		if err := im.ReadLocations(strings.NewReader(locations)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err := im.ReadRanges(strings.NewReader(`network,geoname_id,registered_country_geoname_id,represented_country_geoname_id,is_anonymous_proxy,is_satellite_provider,postal_code,latitude,longitude,accuracy_radius
+81.2.69.0/24,2643743,2635167,,0,0,EC1A,51.5142,-0.0931,20
+81.2.70.0/24,,2635167,,0,0,,,,
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := lookup(t, w, "81.2.69.160")
+	if q.City.Names["en"] != "London" ||
+		q.Country.Names["de"] != "Vereinigtes Königreich" ||
+		q.Continent.Names["de"] != "Europa" ||
+		len(q.Region) != 1 || q.Region[0].ISOCode != "ENG" ||
+		q.Postal.Code != "EC1A" ||
+		q.Location.TimeZone != "Europe/London" {
+		t.Fatalf("Unexpected record: %#v", q)
+	}
+	q = lookup(t, w, "81.2.70.1")
+	if q.Country.ISOCode != "GB" || q.City.Names != nil {
+		t.Fatalf("Unexpected record: %#v", q)
+	}
+}
+
+func TestReadRangesErrors(t *testing.T) {
+	for _, tc := range []struct {
+		format Format
+		data   string
+	}{
+		{FormatHeader, "country_code\nUS\n"},
+		{FormatHeader, "network\nnot-a-network\n"},
+		{FormatHeader, "network,latitude\n1.0.0.0/24,north\n"},
+		{FormatHeader, "network,geoname_id\n1.0.0.0/24,42\n"},
+		{FormatDBIP, "1.0.0.255,1.0.0.0,OC,AU,,,,\n"},
+		{"xml", "<xml/>"},
+	} {
+		im := NewImporter(newTestWriter(), tc.format, "en")
+		if _, err := im.ReadRanges(strings.NewReader(tc.data)); err == nil {
+			t.Errorf("%s %q: unexpected success", tc.format, tc.data)
+		}
+	}
+}
+
+func TestImporterLanguages(t *testing.T) {
+	w := NewWriter(Metadata{DatabaseType: "Test", Languages: []string{"en"}})
+	im := NewImporter(w, FormatHeader, "de")
+	_, err := im.ReadRanges(strings.NewReader("network,city\n10.0.0.0/8,Köln\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(w.meta.Languages, ",") != "en,de" {
+		t.Fatal("Unexpected languages:", w.meta.Languages)
+	}
+}
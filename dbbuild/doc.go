@@ -0,0 +1,11 @@
+// Copyright 2009 The freegeoip authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+// Package dbbuild compiles IP geolocation databases in the MaxMind DB
+// format from CSV sources such as the db-ip and MaxMind CSV editions.
+//
+// The databases are written by a pure Go writer and carry the records
+// read by freegeoip.DefaultQuery, so the output can be served by the
+// freegeoip package like any downloaded database.
+package dbbuild
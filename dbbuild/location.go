@@ -0,0 +1,96 @@
+// Copyright 2009 The freegeoip authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package dbbuild
+
+// Location is the geolocation of a network, with the fields read by
+// freegeoip.DefaultQuery. Names are keyed by language code.
+type Location struct {
+	ContinentCode  string
+	ContinentNames map[string]string
+	CountryCode    string
+	CountryNames   map[string]string
+	Subdivisions   []Subdivision // Largest first.
+	CityNames      map[string]string
+	PostalCode     string
+	Latitude       float64
+	Longitude      float64
+	MetroCode      uint16
+	TimeZone       string
+}
+
+// Subdivision is a region of a country, e.g. a state or province.
+type Subdivision struct {
+	ISOCode string
+	Names   map[string]string
+}
+
+// Record returns the location as a record for Writer.Insert, in the
+// layout of the GeoIP2 City and db-ip City databases. Empty fields are
+// left out.
+func (l *Location) Record() map[string]interface{} {
+	r := make(map[string]interface{})
+	if m := codeNames("code", l.ContinentCode, l.ContinentNames); m != nil {
+		r["continent"] = m
+	}
+	if m := codeNames("iso_code", l.CountryCode, l.CountryNames); m != nil {
+		r["country"] = m
+	}
+	var subdivisions []interface{}
+	for _, s := range l.Subdivisions {
+		if m := codeNames("iso_code", s.ISOCode, s.Names); m != nil {
+			subdivisions = append(subdivisions, m)
+		}
+	}
+	if len(subdivisions) > 0 {
+		r["subdivisions"] = subdivisions
+	}
+	if m := codeNames("", "", l.CityNames); m != nil {
+		r["city"] = m
+	}
+	if l.PostalCode != "" {
+		r["postal"] = map[string]interface{}{"code": l.PostalCode}
+	}
+	location := make(map[string]interface{})
+	if l.Latitude != 0 || l.Longitude != 0 {
+		location["latitude"] = l.Latitude
+		location["longitude"] = l.Longitude
+	}
+	if l.MetroCode != 0 {
+		location["metro_code"] = l.MetroCode
+	}
+	if l.TimeZone != "" {
+		location["time_zone"] = l.TimeZone
+	}
+	if len(location) > 0 {
+		r["location"] = location
+	}
+	return r
+}
+
+func codeNames(key, code string, names map[string]string) map[string]interface{} {
+	m := make(map[string]interface{})
+	if code != "" {
+		m[key] = code
+	}
+	if len(names) > 0 {
+		m["names"] = names
+	}
+	if len(m) == 0 {
+		return nil
+	}
+	return m
+}
+
+// continentNames are the English names of the continent codes used by
+// db-ip and MaxMind, for sources that only carry the code.
+var continentNames = map[string]string{
+	"AF": "Africa",
+	"AN": "Antarctica",
+	"AS": "Asia",
+	"EU": "Europe",
+	"NA": "North America",
+	"OC": "Oceania",
+	"SA": "South America",
+}
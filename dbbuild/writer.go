@@ -0,0 +1,428 @@
+// Copyright 2009 The freegeoip authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package dbbuild
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/big"
+	"net"
+	"sort"
+	"time"
+)
+
+// Metadata describes the database being written.
+type Metadata struct {
+	DatabaseType string            // E.g. "DBIP-City-Lite".
+	Description  map[string]string // Keyed by language code.
+	Languages    []string          // Languages of the names in the records.
+	BuildEpoch   time.Time         // Build date, see DB.BuildDate.
+}
+
+// Writer builds a MaxMind DB file in memory. Networks are stored in an
+// IPv6 search tree, with IPv4 networks in the ::/96 subtree as expected
+// by MaxMind DB readers.
+//
+// Records may be any combination of map[string]interface{},
+// map[string]string, []interface{}, []string, string, bool, float32,
+// float64, int32, uint16, uint32, uint64, uint and int. Identical records
+// are stored only once.
+type Writer struct {
+	meta  Metadata
+	nodes [][2]int32     // 0 is empty, > 0 a node, < 0 a record.
+	data  [][]byte       // Encoded records, in insertion order.
+	index map[string]int // Encoded record to its index in data.
+}
+
+// NewWriter creates and initializes a new Writer.
+func NewWriter(meta Metadata) *Writer {
+	return &Writer{
+		meta:  meta,
+		nodes: make([][2]int32, 1),
+		index: make(map[string]int),
+	}
+}
+
+// Insert stores the record for the given network. Networks inserted
+// later take precedence over the parts of earlier ones they overlap.
+func (w *Writer) Insert(network *net.IPNet, record interface{}) error {
+	ones, bits := network.Mask.Size()
+	if bits == 0 {
+		return fmt.Errorf("invalid network mask: %s", network)
+	}
+	ip := network.IP.To16()
+	if ip == nil {
+		return fmt.Errorf("invalid network address: %s", network)
+	}
+	if bits == 8*net.IPv4len {
+		ones += 96
+		ip = append(make(net.IP, 12), network.IP.To4()...)
+	}
+	v, err := w.record(record)
+	if err != nil {
+		return err
+	}
+	w.insert(ip, ones, v)
+	return nil
+}
+
+// InsertRange stores the record for all addresses from start to end,
+// inclusive, split into the networks covering them.
+func (w *Writer) InsertRange(start, end net.IP, record interface{}) error {
+	networks, err := Range(start, end)
+	if err != nil {
+		return err
+	}
+	for _, n := range networks {
+		err = w.Insert(n, record)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// record returns the tree value of the given record, encoding it into
+// the data section unless an identical record is already there.
+func (w *Writer) record(record interface{}) (int32, error) {
+	var b bytes.Buffer
+	err := encode(&b, record)
+	if err != nil {
+		return 0, err
+	}
+	i, ok := w.index[b.String()]
+	if !ok {
+		if len(w.data) == math.MaxInt32-1 {
+			return 0, errors.New("too many distinct records")
+		}
+		i = len(w.data)
+		w.data = append(w.data, b.Bytes())
+		w.index[b.String()] = i
+	}
+	return -int32(i) - 1, nil
+}
+
+func (w *Writer) insert(ip net.IP, prefix int, v int32) {
+	if prefix == 0 {
+		w.nodes[0] = [2]int32{v, v}
+		return
+	}
+	n := 0
+	for i := 0; i < prefix; i++ {
+		b := ip[i/8] >> (7 - uint(i%8)) & 1
+		if i == prefix-1 {
+			// Subtrees overwritten here become unreachable and
+			// are dropped by WriteTo.
+			w.nodes[n][b] = v
+			return
+		}
+		r := w.nodes[n][b]
+		if r <= 0 {
+			// Split an empty or record leaf into a node whose
+			// both halves inherit it.
+			w.nodes = append(w.nodes, [2]int32{r, r})
+			r = int32(len(w.nodes) - 1)
+			w.nodes[n][b] = r
+		}
+		n = int(r)
+	}
+}
+
+// WriteTo writes the database to out in the MaxMind DB format.
+func (w *Writer) WriteTo(out io.Writer) (int64, error) {
+	// Number the reachable nodes breadth first.
+	ids := make([]int32, len(w.nodes))
+	for i := range ids {
+		ids[i] = -1
+	}
+	order := []int32{0}
+	ids[0] = 0
+	for i := 0; i < len(order); i++ {
+		for _, r := range w.nodes[order[i]] {
+			if r > 0 && ids[r] < 0 {
+				ids[r] = int32(len(order))
+				order = append(order, r)
+			}
+		}
+	}
+	nodeCount := uint64(len(order))
+
+	offsets := make([]uint64, len(w.data))
+	var dataSize uint64
+	for i, d := range w.data {
+		offsets[i] = dataSize
+		dataSize += uint64(len(d))
+	}
+	recordSize := 24
+	switch max := nodeCount + 16 + dataSize; {
+	case max >= 1<<32:
+		return 0, errors.New("database too large")
+	case max >= 1<<28:
+		recordSize = 32
+	case max >= 1<<24:
+		recordSize = 28
+	}
+	value := func(r int32) uint64 {
+		switch {
+		case r > 0:
+			return uint64(ids[r])
+		case r < 0:
+			return nodeCount + 16 + offsets[-r-1]
+		}
+		return nodeCount
+	}
+
+	cw := &countWriter{w: bufio.NewWriter(out)}
+	node := make([]byte, recordSize/4)
+	for _, n := range order {
+		left, right := value(w.nodes[n][0]), value(w.nodes[n][1])
+		switch recordSize {
+		case 24:
+			putUint24(node[0:], left)
+			putUint24(node[3:], right)
+		case 28:
+			putUint24(node[0:], left)
+			node[3] = byte((left>>24)&0x0F<<4 | (right>>24)&0x0F)
+			putUint24(node[4:], right)
+		case 32:
+			binary.BigEndian.PutUint32(node[0:], uint32(left))
+			binary.BigEndian.PutUint32(node[4:], uint32(right))
+		}
+		cw.Write(node)
+	}
+	cw.Write(make([]byte, 16)) // Data section separator.
+	for _, d := range w.data {
+		cw.Write(d)
+	}
+
+	languages := make([]interface{}, len(w.meta.Languages))
+	for i, l := range w.meta.Languages {
+		languages[i] = l
+	}
+	description := make(map[string]interface{})
+	for k, v := range w.meta.Description {
+		description[k] = v
+	}
+	var meta bytes.Buffer
+	err := encode(&meta, map[string]interface{}{
+		"binary_format_major_version": uint16(2),
+		"binary_format_minor_version": uint16(0),
+		"build_epoch":                 uint64(w.meta.BuildEpoch.Unix()),
+		"database_type":               w.meta.DatabaseType,
+		"description":                 description,
+		"ip_version":                  uint16(6),
+		"languages":                   languages,
+		"node_count":                  uint32(nodeCount),
+		"record_size":                 uint16(recordSize),
+	})
+	if err != nil {
+		return cw.n, err
+	}
+	cw.Write(metadataStartMarker)
+	cw.Write(meta.Bytes())
+	if cw.err != nil {
+		return cw.n, cw.err
+	}
+	return cw.n, cw.w.Flush()
+}
+
+var metadataStartMarker = []byte("\xAB\xCD\xEFMaxMind.com")
+
+func putUint24(b []byte, v uint64) {
+	b[0], b[1], b[2] = byte(v>>16), byte(v>>8), byte(v)
+}
+
+// countWriter counts bytes written and keeps the first error.
+type countWriter struct {
+	w   *bufio.Writer
+	n   int64
+	err error
+}
+
+func (cw *countWriter) Write(b []byte) (int, error) {
+	if cw.err != nil {
+		return 0, cw.err
+	}
+	n, err := cw.w.Write(b)
+	cw.n += int64(n)
+	cw.err = err
+	return n, err
+}
+
+// Data section types of the MaxMind DB format.
+const (
+	typeString  = 2
+	typeDouble  = 3
+	typeUint16  = 5
+	typeUint32  = 6
+	typeMap     = 7
+	typeInt32   = 8
+	typeUint64  = 9
+	typeArray   = 11
+	typeBoolean = 14
+	typeFloat   = 15
+)
+
+// encode writes v to b in the MaxMind DB data section format. Map keys
+// are sorted so the same value always has the same encoding.
+func encode(b *bytes.Buffer, v interface{}) error {
+	switch v := v.(type) {
+	case string:
+		writeControl(b, typeString, len(v))
+		b.WriteString(v)
+	case bool:
+		n := 0
+		if v {
+			n = 1
+		}
+		writeControl(b, typeBoolean, n)
+	case float64:
+		writeControl(b, typeDouble, 8)
+		binary.Write(b, binary.BigEndian, v)
+	case float32:
+		writeControl(b, typeFloat, 4)
+		binary.Write(b, binary.BigEndian, v)
+	case int32:
+		writeControl(b, typeInt32, 4)
+		binary.Write(b, binary.BigEndian, v)
+	case uint16:
+		writeUint(b, typeUint16, uint64(v))
+	case uint32:
+		writeUint(b, typeUint32, uint64(v))
+	case uint64:
+		writeUint(b, typeUint64, v)
+	case uint:
+		writeUint(b, typeUint64, uint64(v))
+	case int:
+		if v < 0 {
+			if v < math.MinInt32 {
+				return fmt.Errorf("integer out of range: %d", v)
+			}
+			return encode(b, int32(v))
+		}
+		writeUint(b, typeUint64, uint64(v))
+	case []string:
+		writeControl(b, typeArray, len(v))
+		for _, s := range v {
+			encode(b, s)
+		}
+	case []interface{}:
+		writeControl(b, typeArray, len(v))
+		for _, item := range v {
+			if err := encode(b, item); err != nil {
+				return err
+			}
+		}
+	case map[string]string:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		writeControl(b, typeMap, len(v))
+		for _, k := range keys {
+			encode(b, k)
+			encode(b, v[k])
+		}
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		writeControl(b, typeMap, len(v))
+		for _, k := range keys {
+			encode(b, k)
+			if err := encode(b, v[k]); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("unsupported record type %T", v)
+	}
+	return nil
+}
+
+func writeUint(b *bytes.Buffer, typ int, v uint64) {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], v)
+	n := 0
+	for n < len(buf) && buf[n] == 0 {
+		n++
+	}
+	writeControl(b, typ, len(buf)-n)
+	b.Write(buf[n:])
+}
+
+func writeControl(b *bytes.Buffer, typ int, size int) {
+	var ext []byte
+	switch {
+	case size < 29:
+	case size < 285:
+		ext = []byte{byte(size - 29)}
+		size = 29
+	case size < 65821:
+		size -= 285
+		ext = []byte{byte(size >> 8), byte(size)}
+		size = 30
+	default:
+		size -= 65821
+		ext = []byte{byte(size >> 16), byte(size >> 8), byte(size)}
+		size = 31
+	}
+	if typ > 7 {
+		b.WriteByte(byte(size))
+		b.WriteByte(byte(typ - 7))
+	} else {
+		b.WriteByte(byte(typ<<5 | size))
+	}
+	b.Write(ext)
+}
+
+// Range returns the networks covering all addresses from start to end,
+// inclusive. Both addresses must be of the same family.
+func Range(start, end net.IP) ([]*net.IPNet, error) {
+	bits := 8 * net.IPv6len
+	if s4, e4 := start.To4(), end.To4(); s4 != nil && e4 != nil {
+		start, end, bits = s4, e4, 8*net.IPv4len
+	} else if s4 != nil || e4 != nil || start.To16() == nil || end.To16() == nil {
+		return nil, fmt.Errorf("invalid range: %s-%s", start, end)
+	}
+	s := new(big.Int).SetBytes(start)
+	e := new(big.Int).SetBytes(end)
+	if s.Cmp(e) > 0 {
+		return nil, fmt.Errorf("invalid range: %s-%s", start, end)
+	}
+	var networks []*net.IPNet
+	one := big.NewInt(1)
+	for s.Cmp(e) <= 0 {
+		// Largest block aligned on s that doesn't go past e.
+		size := int(s.TrailingZeroBits())
+		if s.Sign() == 0 {
+			size = bits
+		}
+		for size > 0 {
+			last := new(big.Int).Lsh(one, uint(size))
+			last.Add(last, s).Sub(last, one)
+			if last.Cmp(e) <= 0 {
+				break
+			}
+			size--
+		}
+		ip := make(net.IP, bits/8)
+		s.FillBytes(ip)
+		networks = append(networks, &net.IPNet{
+			IP:   ip,
+			Mask: net.CIDRMask(bits-size, bits),
+		})
+		s.Add(s, new(big.Int).Lsh(one, uint(size)))
+	}
+	return networks, nil
+}
@@ -0,0 +1,207 @@
+// Copyright 2009 The freegeoip authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package dbbuild
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/fiorix/freegeoip"
+	"github.com/oschwald/maxminddb-golang"
+)
+
+func mustCIDR(s string) *net.IPNet {
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(err)
+	}
+	return n
+}
+
+func openWriter(t *testing.T, w *Writer) *maxminddb.Reader {
+	t.Helper()
+	var b bytes.Buffer
+	_, err := w.WriteTo(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader, err := maxminddb.FromBytes(b.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = reader.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return reader
+}
+
+func TestWriter(t *testing.T) {
+	epoch := time.Date(2022, 4, 1, 0, 0, 0, 0, time.UTC)
+	w := NewWriter(Metadata{
+		DatabaseType: "Test-City",
+		Description:  map[string]string{"en": "Test database"},
+		Languages:    []string{"en", "de"},
+		BuildEpoch:   epoch,
+	})
+	venezuela := &Location{
+		ContinentCode:  "SA",
+		ContinentNames: map[string]string{"en": "South America"},
+		CountryCode:    "VE",
+		CountryNames:   map[string]string{"en": "Venezuela", "de": "Venezuela"},
+		Subdivisions: []Subdivision{
+			{ISOCode: "A", Names: map[string]string{"en": "Distrito Federal"}},
+		},
+		CityNames:  map[string]string{"en": "Caracas"},
+		PostalCode: "1010",
+		Latitude:   10.5,
+		Longitude:  -66.9167,
+		MetroCode:  7,
+		TimeZone:   "America/Caracas",
+	}
+	us := &Location{CountryCode: "US", CountryNames: map[string]string{"en": "United States"}}
+	for _, e := range []struct {
+		network string
+		loc     *Location
+	}{
+		{"200.0.0.0/8", venezuela},
+		{"8.8.8.0/24", us},
+		{"2001:4860::/32", us},
+		{"200.1.2.0/24", us}, // Overrides part of 200/8.
+		{"200.1.2.0/26", venezuela},
+	} {
+		if err := w.Insert(mustCIDR(e.network), e.loc.Record()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	reader := openWriter(t, w)
+	defer reader.Close()
+
+	if reader.Metadata.BuildEpoch != uint(epoch.Unix()) {
+		t.Fatal("Unexpected build epoch:", reader.Metadata.BuildEpoch)
+	}
+	if reader.Metadata.DatabaseType != "Test-City" || len(reader.Metadata.Languages) != 2 {
+		t.Fatalf("Unexpected metadata: %#v", reader.Metadata)
+	}
+	for _, tc := range []struct {
+		ip      string
+		country string
+	}{
+		{"200.1.1.1", "VE"},
+		{"200.1.2.1", "VE"},
+		{"200.1.2.100", "US"},
+		{"8.8.8.8", "US"},
+		{"2001:4860:4860::8888", "US"},
+		{"1.1.1.1", ""},
+		{"2001:db8::1", ""},
+	} {
+		var q freegeoip.DefaultQuery
+		err := reader.Lookup(net.ParseIP(tc.ip), &q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if q.Country.ISOCode != tc.country {
+			t.Errorf("%s: want country %q, have %q", tc.ip, tc.country, q.Country.ISOCode)
+		}
+	}
+
+	var q freegeoip.DefaultQuery
+	err := reader.Lookup(net.ParseIP("200.1.1.1"), &q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.City.Names["en"] != "Caracas" ||
+		q.Country.Names["de"] != "Venezuela" ||
+		q.Continent.Names["en"] != "South America" ||
+		len(q.Region) != 1 || q.Region[0].ISOCode != "A" ||
+		q.Postal.Code != "1010" ||
+		q.Location.Latitude != 10.5 || q.Location.Longitude != -66.9167 ||
+		q.Location.MetroCode != 7 ||
+		q.Location.TimeZone != "America/Caracas" {
+		t.Fatalf("Unexpected record: %#v", q)
+	}
+}
+
+func TestWriterRecordSizes(t *testing.T) {
+	// Enough distinct records to need 28 bit pointers.
+	w := NewWriter(Metadata{
+		DatabaseType: "Test",
+		Description:  map[string]string{"en": "Test"},
+	})
+	for i := 0; i < 1<<16; i++ {
+		ip := net.IPv4(10, byte(i>>8), byte(i), 0)
+		n := &net.IPNet{IP: ip, Mask: net.CIDRMask(24, 32)}
+		record := map[string]interface{}{
+			"padding": string(make([]byte, 256)),
+			"id":      uint32(i),
+		}
+		if err := w.Insert(n, record); err != nil {
+			t.Fatal(err)
+		}
+	}
+	reader := openWriter(t, w)
+	defer reader.Close()
+	if reader.Metadata.RecordSize != 28 {
+		t.Fatal("Unexpected record size:", reader.Metadata.RecordSize)
+	}
+	var r struct {
+		ID uint32 `maxminddb:"id"`
+	}
+	err := reader.Lookup(net.ParseIP("10.255.255.1"), &r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.ID != 1<<16-1 {
+		t.Fatal("Unexpected id:", r.ID)
+	}
+}
+
+func TestWriterDeterministic(t *testing.T) {
+	build := func() []byte {
+		w := NewWriter(Metadata{DatabaseType: "Test", BuildEpoch: time.Unix(1, 0)})
+		w.Insert(mustCIDR("1.0.0.0/8"), map[string]interface{}{
+			"a": "x", "b": uint16(1), "c": []interface{}{true, float32(1), int32(-1)},
+		})
+		var b bytes.Buffer
+		w.WriteTo(&b)
+		return b.Bytes()
+	}
+	if !bytes.Equal(build(), build()) {
+		t.Fatal("Output is not deterministic")
+	}
+}
+
+func TestRange(t *testing.T) {
+	for _, tc := range []struct {
+		start, end string
+		want       string
+	}{
+		{"1.0.0.0", "1.0.0.255", "[1.0.0.0/24]"},
+		{"1.0.0.1", "1.0.0.6", "[1.0.0.1/32 1.0.0.2/31 1.0.0.4/31 1.0.0.6/32]"},
+		{"0.0.0.0", "255.255.255.255", "[0.0.0.0/0]"},
+		{"10.0.0.0", "10.0.0.0", "[10.0.0.0/32]"},
+		{"2001:db8::", "2001:db8::ffff", "[2001:db8::/112]"},
+		{"::", "ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff", "[::/0]"},
+	} {
+		networks, err := Range(net.ParseIP(tc.start), net.ParseIP(tc.end))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if have := fmt.Sprint(networks); have != tc.want {
+			t.Errorf("%s-%s: want %s, have %s", tc.start, tc.end, tc.want, have)
+		}
+	}
+	for _, tc := range [][2]string{
+		{"1.0.0.2", "1.0.0.1"},
+		{"1.0.0.0", "::1"},
+	} {
+		if _, err := Range(net.ParseIP(tc[0]), net.ParseIP(tc[1])); err == nil {
+			t.Errorf("%s-%s: unexpected valid range", tc[0], tc[1])
+		}
+	}
+}
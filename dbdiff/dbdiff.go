@@ -0,0 +1,351 @@
+// Copyright 2009 The freegeoip authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+// Package dbdiff compares two builds of an IP geolocation database in
+// the MaxMind DB format.
+//
+// Records are decoded as freegeoip.DefaultQuery, so only changes to the
+// data served by the API are reported. Networks are compared by address
+// rather than by prefix, and builds that split the same ranges in a
+// different way have no differences.
+package dbdiff
+
+import (
+	"bytes"
+	"net"
+	"reflect"
+
+	"github.com/fiorix/freegeoip"
+	"github.com/fiorix/freegeoip/dbbuild"
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// Kind is the kind of a change.
+type Kind string
+
+// Kinds of changes.
+const (
+	Added   Kind = "added"
+	Removed Kind = "removed"
+	Changed Kind = "changed"
+)
+
+// Unknown is the country code of networks without a country.
+const Unknown = "-"
+
+// Change is a network that differs between two builds.
+type Change struct {
+	Kind    Kind      `json:"kind"`
+	Network string    `json:"network"`
+	Fields  []string  `json:"fields,omitempty"` // Changed fields, see Fields.
+	Old     *Location `json:"old,omitempty"`
+	New     *Location `json:"new,omitempty"`
+}
+
+// Fields are the names of the fields compared, in the order they are
+// listed in Change.Fields.
+var Fields = []string{"continent", "country", "region", "city", "postal", "location"}
+
+// Location is the summary of a record shown in changes.
+type Location struct {
+	CountryCode string  `json:"country_code"`
+	RegionCode  string  `json:"region_code,omitempty"`
+	City        string  `json:"city,omitempty"`
+	Latitude    float64 `json:"latitude"`
+	Longitude   float64 `json:"longitude"`
+}
+
+// Summary counts changed networks.
+type Summary struct {
+	Added    int `json:"added"`
+	Removed  int `json:"removed"`
+	Changed  int `json:"changed"`             // Including MovedIn.
+	MovedIn  int `json:"moved_in,omitempty"`  // Changed from another country.
+	MovedOut int `json:"moved_out,omitempty"` // Changed to another country.
+}
+
+// Report is the result of a comparison. Networks are counted as
+// prefixes in CIDR notation.
+type Report struct {
+	Summary
+	Fields    map[string]int      `json:"fields"`    // Changed networks by field.
+	Countries map[string]*Summary `json:"countries"` // By country code.
+	Changes   []*Change           `json:"changes,omitempty"`
+}
+
+func (r *Report) country(code string) *Summary {
+	if code == "" {
+		code = Unknown
+	}
+	s, ok := r.Countries[code]
+	if !ok {
+		s = &Summary{}
+		r.Countries[code] = s
+	}
+	return s
+}
+
+func (r *Report) add(c *Change) {
+	switch c.Kind {
+	case Added:
+		r.Added++
+		r.country(c.New.CountryCode).Added++
+	case Removed:
+		r.Removed++
+		r.country(c.Old.CountryCode).Removed++
+	case Changed:
+		r.Changed++
+		r.country(c.New.CountryCode).Changed++
+		if c.Old.CountryCode != c.New.CountryCode {
+			r.MovedIn++
+			r.MovedOut++
+			r.country(c.New.CountryCode).MovedIn++
+			r.country(c.Old.CountryCode).MovedOut++
+		}
+		for _, f := range c.Fields {
+			r.Fields[f]++
+		}
+	}
+}
+
+// Compare walks the networks of both databases and returns a report of
+// their differences. Every change is passed to fn in address order, if
+// fn is not nil; changes are not kept in the report.
+func Compare(old, newer *maxminddb.Reader, fn func(*Change)) (*Report, error) {
+	d := &differ{
+		report: &Report{
+			Fields:    make(map[string]int),
+			Countries: make(map[string]*Summary),
+		},
+		fn: fn,
+	}
+	a := &cursor{n: old.Networks(maxminddb.SkipAliasedNetworks)}
+	b := &cursor{n: newer.Networks(maxminddb.SkipAliasedNetworks)}
+	if err := a.next(); err != nil {
+		return nil, err
+	}
+	if err := b.next(); err != nil {
+		return nil, err
+	}
+	for a.ok || b.ok {
+		var err error
+		switch {
+		case !b.ok || (a.ok && less(a.start, b.start)):
+			end := a.end
+			if b.ok && less(b.start, end) {
+				end = dec(b.start)
+			}
+			err = d.add(Removed, a.start, end, &a.rec, nil)
+			if err == nil {
+				err = a.skip(end)
+			}
+		case !a.ok || less(b.start, a.start):
+			end := b.end
+			if a.ok && less(a.start, end) {
+				end = dec(a.start)
+			}
+			err = d.add(Added, b.start, end, nil, &b.rec)
+			if err == nil {
+				err = b.skip(end)
+			}
+		default:
+			end := a.end
+			if less(b.end, end) {
+				end = b.end
+			}
+			if !reflect.DeepEqual(a.rec, b.rec) {
+				err = d.add(Changed, a.start, end, &a.rec, &b.rec)
+			}
+			if err == nil {
+				err = a.skip(end)
+			}
+			if err == nil {
+				err = b.skip(end)
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := d.flush(); err != nil {
+		return nil, err
+	}
+	return d.report, nil
+}
+
+// addr is an address in the layout of the search tree, with IPv4
+// addresses in ::/96.
+type addr [net.IPv6len]byte
+
+func less(a, b addr) bool {
+	return bytes.Compare(a[:], b[:]) < 0
+}
+
+func dec(a addr) addr {
+	for i := len(a) - 1; i >= 0; i-- {
+		a[i]--
+		if a[i] != 0xff {
+			break
+		}
+	}
+	return a
+}
+
+func inc(a addr) addr {
+	for i := len(a) - 1; i >= 0; i-- {
+		a[i]++
+		if a[i] != 0 {
+			break
+		}
+	}
+	return a
+}
+
+func isIPv4(a addr) bool {
+	var zero [12]byte
+	return bytes.Equal(a[:12], zero[:])
+}
+
+func (a addr) ip() net.IP {
+	if isIPv4(a) {
+		return net.IP(append([]byte(nil), a[12:]...))
+	}
+	return net.IP(append([]byte(nil), a[:]...))
+}
+
+// cursor iterates over the networks of a database as address ranges.
+type cursor struct {
+	n          *maxminddb.Networks
+	ok         bool
+	start, end addr
+	rec        freegeoip.DefaultQuery
+}
+
+func (c *cursor) next() error {
+	c.ok = c.n.Next()
+	if !c.ok {
+		return c.n.Err()
+	}
+	c.rec = freegeoip.DefaultQuery{}
+	network, err := c.n.Network(&c.rec)
+	if err != nil {
+		return err
+	}
+	ip, mask := network.IP, network.Mask
+	if ip4 := ip.To4(); ip4 != nil && len(mask) == net.IPv4len {
+		ip, mask = append(make(net.IP, 12), ip4...), append(net.CIDRMask(96, 128)[:12], mask...)
+	}
+	for i := range c.start {
+		c.start[i] = ip[i] & mask[i]
+		c.end[i] = ip[i] | ^mask[i]
+	}
+	return nil
+}
+
+// skip moves the start of the current range after end, which must be
+// in the range.
+func (c *cursor) skip(end addr) error {
+	if end == c.end {
+		return c.next()
+	}
+	c.start = inc(end)
+	return nil
+}
+
+// differ merges contiguous ranges with the same change before they are
+// split into prefixes.
+type differ struct {
+	report *Report
+	fn     func(*Change)
+
+	pending    bool
+	kind       Kind
+	start, end addr
+	old, newer *freegeoip.DefaultQuery
+}
+
+func (d *differ) add(kind Kind, start, end addr, old, newer *freegeoip.DefaultQuery) error {
+	if d.pending && kind == d.kind && inc(d.end) == start &&
+		isIPv4(start) == isIPv4(d.start) &&
+		reflect.DeepEqual(old, d.old) && reflect.DeepEqual(newer, d.newer) {
+		d.end = end
+		return nil
+	}
+	if err := d.flush(); err != nil {
+		return err
+	}
+	d.pending, d.kind, d.start, d.end = true, kind, start, end
+	d.old, d.newer = copyQuery(old), copyQuery(newer)
+	return nil
+}
+
+func (d *differ) flush() error {
+	if !d.pending {
+		return nil
+	}
+	d.pending = false
+	networks, err := dbbuild.Range(d.start.ip(), d.end.ip())
+	if err != nil {
+		return err
+	}
+	var fields []string
+	if d.kind == Changed {
+		fields = changedFields(d.old, d.newer)
+	}
+	for _, network := range networks {
+		c := &Change{
+			Kind:    d.kind,
+			Network: network.String(),
+			Fields:  fields,
+			Old:     summarize(d.old),
+			New:     summarize(d.newer),
+		}
+		d.report.add(c)
+		if d.fn != nil {
+			d.fn(c)
+		}
+	}
+	return nil
+}
+
+func copyQuery(q *freegeoip.DefaultQuery) *freegeoip.DefaultQuery {
+	if q == nil {
+		return nil
+	}
+	c := *q
+	return &c
+}
+
+func changedFields(old, newer *freegeoip.DefaultQuery) []string {
+	var fields []string
+	for i, eq := range []bool{
+		reflect.DeepEqual(old.Continent, newer.Continent),
+		reflect.DeepEqual(old.Country, newer.Country),
+		reflect.DeepEqual(old.Region, newer.Region),
+		reflect.DeepEqual(old.City, newer.City),
+		reflect.DeepEqual(old.Postal, newer.Postal),
+		reflect.DeepEqual(old.Location, newer.Location),
+	} {
+		if !eq {
+			fields = append(fields, Fields[i])
+		}
+	}
+	return fields
+}
+
+func summarize(q *freegeoip.DefaultQuery) *Location {
+	if q == nil {
+		return nil
+	}
+	l := &Location{
+		CountryCode: q.Country.ISOCode,
+		City:        q.City.Names["en"],
+		Latitude:    q.Location.Latitude,
+		Longitude:   q.Location.Longitude,
+	}
+	if len(q.Region) > 0 {
+		l.RegionCode = q.Region[0].ISOCode
+	}
+	return l
+}
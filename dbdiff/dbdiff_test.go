@@ -0,0 +1,133 @@
+// Copyright 2009 The freegeoip authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package dbdiff
+
+import (
+	"bytes"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/fiorix/freegeoip/dbbuild"
+	"github.com/fiorix/freegeoip/internal/testdb"
+	"github.com/oschwald/maxminddb-golang"
+)
+
+func openTestDB(t *testing.T, b []byte) *maxminddb.Reader {
+	t.Helper()
+	r, err := maxminddb.FromBytes(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+// buildTestDB returns the test database with the given networks
+// replaced, added or removed when their location is nil.
+func buildTestDB(t *testing.T, changes map[string]*dbbuild.Location) []byte {
+	t.Helper()
+	w := dbbuild.NewWriter(dbbuild.Metadata{
+		DatabaseType: "Test-City",
+		Description:  map[string]string{"en": "Test database"},
+		BuildEpoch:   testdb.BuildDate,
+	})
+	insert := func(cidr string, loc *dbbuild.Location) {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = w.Insert(network, loc.Record()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, n := range testdb.Networks {
+		if loc, ok := changes[n.CIDR]; !ok {
+			insert(n.CIDR, &n.Location)
+		} else if loc != nil {
+			insert(n.CIDR, loc)
+		}
+	}
+	for cidr, loc := range changes {
+		if loc != nil {
+			insert(cidr, loc)
+		}
+	}
+	var b bytes.Buffer
+	if _, err := w.WriteTo(&b); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func TestCompareSame(t *testing.T) {
+	old := openTestDB(t, testdb.Bytes())
+	// Splitting networks in a different way is not a change.
+	loc := testdb.Networks[0].Location
+	newer := openTestDB(t, buildTestDB(t, map[string]*dbbuild.Location{
+		"8.8.8.0/24":   nil,
+		"8.8.8.0/25":   &loc,
+		"8.8.8.128/25": &loc,
+	}))
+	report, err := Compare(old, newer, func(c *Change) {
+		t.Errorf("Unexpected change: %+v", c)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Summary != (Summary{}) || len(report.Countries) != 0 {
+		t.Fatalf("Unexpected report: %+v", report)
+	}
+}
+
+func TestCompare(t *testing.T) {
+	byCIDR := make(map[string]dbbuild.Location)
+	for _, n := range testdb.Networks {
+		byCIDR[n.CIDR] = n.Location
+	}
+	paloAlto := byCIDR["8.8.8.0/24"]
+	paloAlto.CityNames = map[string]string{"en": "Palo Alto"}
+	ireland := byCIDR["81.2.69.0/24"]
+	ireland.CountryCode = "IE"
+	cloudflare := byCIDR["8.8.8.0/24"]
+
+	old := openTestDB(t, testdb.Bytes())
+	newer := openTestDB(t, buildTestDB(t, map[string]*dbbuild.Location{
+		"8.8.8.128/25": &paloAlto,
+		"81.2.69.0/24": &ireland,
+		"200.1.2.0/24": nil,
+		"1.1.1.0/24":   &cloudflare,
+	}))
+	var changes []string
+	report, err := Compare(old, newer, func(c *Change) {
+		changes = append(changes, string(c.Kind)+" "+c.Network)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"added 1.1.1.0/24",
+		"changed 8.8.8.128/25",
+		"changed 81.2.69.0/24",
+		"removed 200.1.2.0/24",
+	}
+	if !reflect.DeepEqual(changes, want) {
+		t.Fatalf("Unexpected changes:\nhave %q\nwant %q", changes, want)
+	}
+	if want := (Summary{Added: 1, Removed: 1, Changed: 2, MovedIn: 1, MovedOut: 1}); report.Summary != want {
+		t.Fatalf("Unexpected summary: %+v", report.Summary)
+	}
+	countries := map[string]*Summary{
+		"US": {Added: 1, Changed: 1},
+		"VE": {Removed: 1},
+		"IE": {Changed: 1, MovedIn: 1},
+		"GB": {MovedOut: 1},
+	}
+	if !reflect.DeepEqual(report.Countries, countries) {
+		t.Fatalf("Unexpected countries: %+v", report.Countries)
+	}
+	if want := map[string]int{"country": 1, "city": 1}; !reflect.DeepEqual(report.Fields, want) {
+		t.Fatalf("Unexpected fields: %v", report.Fields)
+	}
+}
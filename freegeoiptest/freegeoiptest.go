@@ -0,0 +1,116 @@
+// Copyright 2009 The freegeoip authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+// Package freegeoiptest provides a small deterministic IP database and
+// helpers to write hermetic tests against freegeoip and its web server,
+// without downloading a real database.
+//
+// The database maps the networks returned by Networks to known cities,
+// subdivisions and names in several languages, e.g. 8.8.8.8 is in
+// Mountain View, United States and 200.1.2.3 is in Caracas, Venezuela.
+package freegeoiptest
+
+import (
+	"io"
+	"net/http"
+	"path/filepath"
+	"testing"
+
+	"github.com/fiorix/freegeoip"
+	"github.com/fiorix/freegeoip/apiserver"
+	"github.com/fiorix/freegeoip/dbbuild"
+	"github.com/fiorix/freegeoip/internal/testdb"
+)
+
+// Network is a network of the test database and its location.
+type Network = testdb.Network
+
+// BuildDate is the build date of the test database.
+var BuildDate = testdb.BuildDate
+
+// Networks returns the networks of the test database. It returns a new
+// copy on each call, which the caller may change.
+func Networks() []Network {
+	networks := make([]Network, len(testdb.Networks))
+	for i, n := range testdb.Networks {
+		loc := n.Location
+		loc.ContinentNames = copyNames(loc.ContinentNames)
+		loc.CountryNames = copyNames(loc.CountryNames)
+		loc.CityNames = copyNames(loc.CityNames)
+		loc.Subdivisions = append([]dbbuild.Subdivision(nil), loc.Subdivisions...)
+		for j := range loc.Subdivisions {
+			loc.Subdivisions[j].Names = copyNames(loc.Subdivisions[j].Names)
+		}
+		networks[i] = Network{CIDR: n.CIDR, Location: loc}
+	}
+	return networks
+}
+
+func copyNames(names map[string]string) map[string]string {
+	if names == nil {
+		return nil
+	}
+	c := make(map[string]string, len(names))
+	for k, v := range names {
+		c[k] = v
+	}
+	return c
+}
+
+// Languages returns the languages of the names in the test database.
+func Languages() []string {
+	return append([]string(nil), testdb.Languages...)
+}
+
+// Bytes returns the test database in the MaxMind DB format.
+func Bytes() []byte {
+	return testdb.Bytes()
+}
+
+// WriteFile writes the test database to the named file, compressed
+// with gzip as expected by freegeoip.Open.
+func WriteFile(name string) error {
+	return testdb.WriteFile(name)
+}
+
+// TempFile writes the test database to a temporary directory that is
+// removed when the test finishes, and returns the file name.
+func TempFile(t testing.TB) string {
+	t.Helper()
+	name := filepath.Join(t.TempDir(), "db.gz")
+	err := WriteFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+// OpenDB opens the test database. It is closed when the test finishes.
+func OpenDB(t testing.TB, opts ...freegeoip.Option) *freegeoip.DB {
+	t.Helper()
+	db, err := freegeoip.Open(TempFile(t), opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(db.Close)
+	return db
+}
+
+// NewHandler creates a freegeoip web server handler serving the test
+// database, which is closed when the test finishes. The configuration
+// may be nil for the defaults, and its DB field is always replaced.
+func NewHandler(t testing.TB, c *apiserver.Config) http.Handler {
+	t.Helper()
+	if c == nil {
+		c = apiserver.NewConfig()
+		c.Silent = true
+	}
+	c.DB = TempFile(t)
+	f, err := apiserver.NewHandler(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.(io.Closer).Close() })
+	return f
+}
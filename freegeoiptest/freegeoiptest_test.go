@@ -0,0 +1,74 @@
+// Copyright 2009 The freegeoip authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package freegeoiptest
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/fiorix/freegeoip"
+)
+
+func TestOpenDB(t *testing.T) {
+	db := OpenDB(t)
+	if !db.BuildDate().Equal(BuildDate) {
+		t.Fatal("Unexpected build date:", db.BuildDate())
+	}
+	for _, n := range Networks() {
+		ip, _, err := net.ParseCIDR(n.CIDR)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var q freegeoip.DefaultQuery
+		err = db.Lookup(ip, &q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if q.Country.ISOCode != n.Location.CountryCode {
+			t.Errorf("%s: want country %q, have %q", ip, n.Location.CountryCode, q.Country.ISOCode)
+		}
+	}
+}
+
+func TestNetworksCopy(t *testing.T) {
+	n := Networks()
+	n[0].CIDR = "192.0.2.0/24"
+	n[0].Location.CountryNames["en"] = "Nowhere"
+	n[0].Location.Subdivisions[0].Names["en"] = "Nowhere"
+	if v := Networks()[0]; v.CIDR == n[0].CIDR || v.Location.CountryNames["en"] == "Nowhere" ||
+		v.Location.Subdivisions[0].Names["en"] == "Nowhere" {
+		t.Fatalf("Unexpected change of the networks: %+v", v)
+	}
+}
+
+func TestNewHandler(t *testing.T) {
+	f := NewHandler(t, nil)
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/json/8.8.8.8", nil)
+	r.Header.Set("Accept-Language", "de")
+	f.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Unexpected response: %d %s", w.Code, w.Body.String())
+	}
+	var m struct {
+		Country string `json:"country_name"`
+		Region  string `json:"region_name"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&m); err != nil {
+		t.Fatal(err)
+	}
+	if m.Country != "USA" || m.Region != "Kalifornien" {
+		t.Fatalf("Unexpected response: %+v", m)
+	}
+}
+
+func TestDeterministic(t *testing.T) {
+	if string(Bytes()) != string(Bytes()) {
+		t.Fatal("Test database is not deterministic")
+	}
+}
@@ -0,0 +1,239 @@
+// Copyright 2009 The freegeoip authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package freegeoip
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrNoBuild is returned by DB.LookupAt when no database build was
+// active at the requested time.
+var ErrNoBuild = errors.New("no database build available for the given time")
+
+// Layout of the load time in the file names of the history directory,
+// which are the load time and the checksum of the build.
+const historyLayout = "20060102T150405.000000000Z"
+
+// WithHistory keeps previous database builds in dir, indexed by the
+// time they were loaded, so that DB.LookupAt can query the build that
+// was active at a given time.
+//
+// Builds are archived every time a database with a new checksum is
+// loaded. Only the newest maxCount builds are kept, and builds replaced
+// more than maxAge ago are removed. Zero disables either limit.
+func WithHistory(dir string, maxCount int, maxAge time.Duration) Option {
+	return func(db *DB) {
+		db.history = &history{
+			dir:      dir,
+			maxCount: maxCount,
+			maxAge:   maxAge,
+		}
+	}
+}
+
+// history is an on-disk archive of database builds.
+type history struct {
+	dir      string
+	maxCount int
+	maxAge   time.Duration
+
+	mu     sync.Mutex
+	builds []historyBuild // Sorted by load time, oldest first.
+	file   string         // File of the cached reader.
+	reader reader         // Most recently used old build.
+}
+
+type historyBuild struct {
+	date     time.Time // When the build was loaded.
+	checksum string
+	file     string
+}
+
+// add copies the database file, loaded at the given time, into the
+// archive unless it is the newest build there, e.g. after a restart,
+// then applies the retention policy.
+func (h *history) add(dbfile, checksum string, loaded time.Time, now time.Time) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	err := os.MkdirAll(h.dir, 0755)
+	if err != nil {
+		return err
+	}
+	err = h.scan()
+	if err != nil {
+		return err
+	}
+	if n := len(h.builds); n == 0 || h.builds[n-1].checksum != checksum {
+		name := loaded.UTC().Format(historyLayout) + "-" + checksum + ".db.gz"
+		err = copyFile(dbfile, filepath.Join(h.dir, name))
+		if err != nil {
+			return err
+		}
+		err = h.scan()
+		if err != nil {
+			return err
+		}
+	}
+	return h.prune(now)
+}
+
+// scan rebuilds the index from the files in the archive directory.
+func (h *history) scan() error {
+	files, err := ioutil.ReadDir(h.dir)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	h.builds = []historyBuild{}
+	for _, f := range files {
+		name := f.Name()
+		if f.IsDir() || !strings.HasSuffix(name, ".db.gz") {
+			continue
+		}
+		prefix, checksum, ok := strings.Cut(strings.TrimSuffix(name, ".db.gz"), "-")
+		if !ok {
+			continue // Not ours.
+		}
+		date, err := time.Parse(historyLayout, prefix)
+		if err != nil {
+			continue
+		}
+		h.builds = append(h.builds, historyBuild{
+			date:     date,
+			checksum: checksum,
+			file:     filepath.Join(h.dir, name),
+		})
+	}
+	sort.Slice(h.builds, func(i, j int) bool {
+		return h.builds[i].date.Before(h.builds[j].date)
+	})
+	return nil
+}
+
+// prune removes builds exceeding the retention policy. The newest build
+// is always kept, and the age of the others is that of the build that
+// replaced them.
+func (h *history) prune(now time.Time) error {
+	var keep []historyBuild
+	for i, b := range h.builds {
+		newest := i == len(h.builds)-1
+		tooMany := h.maxCount > 0 && len(h.builds)-i > h.maxCount
+		tooOld := !newest && h.maxAge > 0 && now.Sub(h.builds[i+1].date) > h.maxAge
+		if !newest && (tooMany || tooOld) {
+			if b.file == h.file {
+				h.closeReader()
+			}
+			err := os.Remove(b.file)
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			continue
+		}
+		keep = append(keep, b)
+	}
+	h.builds = keep
+	return nil
+}
+
+// find returns the newest build loaded at or before t.
+func (h *history) find(t time.Time) (historyBuild, bool) {
+	i := sort.Search(len(h.builds), func(i int) bool {
+		return h.builds[i].date.After(t)
+	})
+	if i == 0 {
+		return historyBuild{}, false
+	}
+	return h.builds[i-1], true
+}
+
+// lookup performs a lookup against the build that was active at t.
+func (h *history) lookup(db *DB, addr net.IP, t time.Time, result interface{}) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.builds == nil {
+		if err := h.scan(); err != nil {
+			return err
+		}
+	}
+	b, ok := h.find(t)
+	if !ok {
+		return ErrNoBuild
+	}
+	if h.file != b.file {
+		reader, _, err := db.newReader(b.file)
+		if err != nil {
+			return err
+		}
+		h.closeReader()
+		h.file, h.reader = b.file, reader
+	}
+	return h.reader.Lookup(addr, result)
+}
+
+func (h *history) closeReader() {
+	if h.reader != nil {
+		h.reader.Close()
+	}
+	h.file, h.reader = "", nil
+}
+
+func (h *history) close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.closeReader()
+}
+
+// LookupAt is like Lookup but uses the database build that was active,
+// i.e. loaded and not yet replaced, at the given time. Builds older than
+// the current one are only available when the DB was opened with
+// WithHistory.
+//
+// ErrNoBuild is returned if no build was active at that time.
+func (db *DB) LookupAt(addr net.IP, t time.Time, result interface{}) error {
+	db.mu.RLock()
+	if db.reader != nil && !t.Before(db.loaded) {
+		defer db.mu.RUnlock()
+		return db.reader.Lookup(addr, result)
+	}
+	current := db.reader != nil
+	db.mu.RUnlock()
+	if db.history == nil {
+		if !current {
+			return ErrUnavailable
+		}
+		return ErrNoBuild
+	}
+	return db.history.lookup(db, addr, t, result)
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	tmp := dst + ".tmp"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, dst)
+}
@@ -0,0 +1,174 @@
+// Copyright 2009 The freegeoip authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package freegeoip
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newTestHistory returns a history of builds loaded on the given days.
+func newTestHistory(t *testing.T, days ...string) *history {
+	h := &history{dir: t.TempDir()}
+	for i, d := range days {
+		if err := ioutil.WriteFile(testHistoryFile(t, h.dir, d, i), []byte(d), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Unrelated files must be ignored.
+	ioutil.WriteFile(filepath.Join(h.dir, "README"), nil, 0644)
+	ioutil.WriteFile(filepath.Join(h.dir, "20220101T000000Z.db.gz"), nil, 0644)
+	if err := h.scan(); err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+// testHistoryFile returns the file in dir of a test build loaded on day.
+func testHistoryFile(t *testing.T, dir, day string, checksum int) string {
+	date, err := time.Parse("2006-01-02", day)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filepath.Join(dir, fmt.Sprintf("%s-%x.db.gz", date.Format(historyLayout), checksum))
+}
+
+func TestHistoryFind(t *testing.T) {
+	h := newTestHistory(t, "2022-03-01", "2022-01-01", "2022-02-01")
+	for _, tc := range []struct {
+		at   string
+		want int // Index of the build, -1 for none.
+	}{
+		{"2021-12-31T23:59:59Z", -1},
+		{"2022-01-01T00:00:00Z", 1},
+		{"2022-02-15T10:00:00Z", 2},
+		{"2023-01-01T00:00:00Z", 0},
+	} {
+		at, _ := time.Parse(time.RFC3339, tc.at)
+		b, ok := h.find(at)
+		if tc.want < 0 {
+			if ok {
+				t.Errorf("%s: unexpected build %s", tc.at, b.file)
+			}
+			continue
+		}
+		if want := fmt.Sprintf("%x", tc.want); !ok || b.checksum != want {
+			t.Errorf("%s: want build %s, have %q", tc.at, want, b.file)
+		}
+	}
+}
+
+func TestHistoryPrune(t *testing.T) {
+	h := newTestHistory(t, "2022-01-01", "2022-02-01", "2022-03-01", "2022-04-01")
+	now, _ := time.Parse(time.RFC3339, "2022-04-15T00:00:00Z")
+
+	h.maxCount = 3
+	if err := h.prune(now); err != nil {
+		t.Fatal(err)
+	}
+	if len(h.builds) != 3 {
+		t.Fatalf("Unexpected number of builds after pruning by count: %d", len(h.builds))
+	}
+	if _, err := os.Stat(testHistoryFile(t, h.dir, "2022-01-01", 0)); !os.IsNotExist(err) {
+		t.Fatal("Oldest build was not removed")
+	}
+
+	// The build of March was replaced less than 30 days ago.
+	h.maxAge = 30 * 24 * time.Hour
+	if err := h.prune(now); err != nil {
+		t.Fatal(err)
+	}
+	if len(h.builds) != 2 || h.builds[0].file != testHistoryFile(t, h.dir, "2022-03-01", 2) {
+		t.Fatalf("Unexpected builds after pruning by age: %v", h.builds)
+	}
+
+	// The newest build is kept no matter how old.
+	if err := h.prune(now.AddDate(10, 0, 0)); err != nil {
+		t.Fatal(err)
+	}
+	if len(h.builds) != 1 {
+		t.Fatal("Newest build was removed")
+	}
+}
+
+func TestLookupAt(t *testing.T) {
+	dir := t.TempDir()
+	before := time.Now()
+	db, err := Open(testFile, WithHistory(dir, 2, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Fatalf("Unexpected number of archived builds: %d", len(files))
+	}
+	var record DefaultQuery
+	err = db.LookupAt(net.ParseIP("8.8.8.8"), time.Now(), &record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.Country.ISOCode != "US" {
+		t.Fatal("Unexpected ISO code:", record.Country.ISOCode)
+	}
+	// Builds are selected by when they were loaded, not built.
+	err = db.LookupAt(net.ParseIP("8.8.8.8"), before.Add(-time.Second), &record)
+	if err != ErrNoBuild {
+		t.Fatal("Unexpected error:", err)
+	}
+}
+
+func TestLookupAtSameBuildDate(t *testing.T) {
+	dir, file := t.TempDir(), filepath.Join(t.TempDir(), "db.gz")
+	writeCountries(t, file, map[string]string{"8.8.8.0/24": "US"})
+	db, err := Open(file, WithHistory(dir, 0, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	<-db.NotifyOpen()
+	first := time.Now()
+
+	// Same build date, different data.
+	writeCountries(t, file, map[string]string{"8.8.8.0/24": "DE"})
+	select {
+	case <-db.NotifyOpen():
+	case err := <-db.NotifyError():
+		t.Fatal(err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(files) == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Unexpected number of archived builds: %d", len(files))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for at, want := range map[time.Time]string{first: "US", time.Now(): "DE"} {
+		var q countryQuery
+		if err = db.LookupAt(net.ParseIP("8.8.8.8"), at, &q); err != nil {
+			t.Fatal(err)
+		}
+		if q.Country.ISOCode != want {
+			t.Errorf("Unexpected country at %s: %q, want %q", at, q.Country.ISOCode, want)
+		}
+	}
+}
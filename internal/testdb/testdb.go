@@ -0,0 +1,150 @@
+// Copyright 2009 The freegeoip authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+// Package testdb builds the small deterministic database used by the
+// tests of this repository, and published by package freegeoiptest.
+package testdb
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net"
+	"time"
+
+	"github.com/fiorix/freegeoip/dbbuild"
+)
+
+// BuildDate is the build date recorded in the database metadata.
+var BuildDate = time.Date(2022, 4, 1, 0, 0, 0, 0, time.UTC)
+
+// Languages of the names in the database.
+var Languages = []string{"en", "de", "fr", "ja"}
+
+// Network is a network of the database and its location.
+type Network struct {
+	CIDR     string
+	Location dbbuild.Location
+}
+
+var (
+	northAmerica = map[string]string{"en": "North America", "de": "Nordamerika", "fr": "Amérique du Nord", "ja": "北アメリカ"}
+	southAmerica = map[string]string{"en": "South America", "de": "Südamerika", "fr": "Amérique du Sud", "ja": "南アメリカ"}
+	europe       = map[string]string{"en": "Europe", "de": "Europa", "fr": "Europe", "ja": "ヨーロッパ"}
+
+	unitedStates = dbbuild.Location{
+		ContinentCode:  "NA",
+		ContinentNames: northAmerica,
+		CountryCode:    "US",
+		CountryNames:   map[string]string{"en": "United States", "de": "USA", "fr": "États-Unis", "ja": "アメリカ合衆国"},
+		Subdivisions: []dbbuild.Subdivision{
+			{ISOCode: "CA", Names: map[string]string{"en": "California", "de": "Kalifornien", "fr": "Californie", "ja": "カリフォルニア州"}},
+		},
+		CityNames:  map[string]string{"en": "Mountain View", "ja": "マウンテンビュー"},
+		PostalCode: "94035",
+		Latitude:   37.386,
+		Longitude:  -122.0838,
+		MetroCode:  807,
+		TimeZone:   "America/Los_Angeles",
+	}
+)
+
+// Networks are the networks of the database, in insertion order.
+var Networks = []Network{
+	{"8.8.8.0/24", unitedStates},
+	{"2001:4860::/32", unitedStates},
+	{"200.1.2.0/24", dbbuild.Location{
+		ContinentCode:  "SA",
+		ContinentNames: southAmerica,
+		CountryCode:    "VE",
+		CountryNames:   map[string]string{"en": "Venezuela", "de": "Venezuela", "fr": "Venezuela", "ja": "ベネズエラ"},
+		Subdivisions: []dbbuild.Subdivision{
+			{ISOCode: "A", Names: map[string]string{"en": "Distrito Federal"}},
+		},
+		CityNames:  map[string]string{"en": "Caracas", "de": "Caracas", "fr": "Caracas", "ja": "カラカス"},
+		PostalCode: "1010",
+		Latitude:   10.488,
+		Longitude:  -66.8792,
+		TimeZone:   "America/Caracas",
+	}},
+	{"81.2.69.0/24", dbbuild.Location{
+		ContinentCode:  "EU",
+		ContinentNames: europe,
+		CountryCode:    "GB",
+		CountryNames:   map[string]string{"en": "United Kingdom", "de": "Vereinigtes Königreich", "fr": "Royaume-Uni", "ja": "イギリス"},
+		Subdivisions: []dbbuild.Subdivision{
+			{ISOCode: "ENG", Names: map[string]string{"en": "England", "de": "England", "fr": "Angleterre", "ja": "イングランド"}},
+			{ISOCode: "WBK", Names: map[string]string{"en": "West Berkshire"}},
+		},
+		CityNames:  map[string]string{"en": "Boxford"},
+		PostalCode: "OX1",
+		Latitude:   51.75,
+		Longitude:  -1.25,
+		TimeZone:   "Europe/London",
+	}},
+	{"46.4.0.0/16", dbbuild.Location{
+		ContinentCode:  "EU",
+		ContinentNames: europe,
+		CountryCode:    "DE",
+		CountryNames:   map[string]string{"en": "Germany", "de": "Deutschland", "fr": "Allemagne", "ja": "ドイツ連邦共和国"},
+		Subdivisions: []dbbuild.Subdivision{
+			{ISOCode: "BY", Names: map[string]string{"en": "Bavaria", "de": "Bayern", "fr": "Bavière"}},
+		},
+		CityNames:  map[string]string{"en": "Munich", "de": "München", "fr": "Munich", "ja": "ミュンヘン"},
+		PostalCode: "80331",
+		Latitude:   48.1374,
+		Longitude:  11.5755,
+		TimeZone:   "Europe/Berlin",
+	}},
+	{"2a01:4f8::/32", dbbuild.Location{
+		ContinentCode:  "EU",
+		ContinentNames: europe,
+		CountryCode:    "DE",
+		CountryNames:   map[string]string{"en": "Germany", "de": "Deutschland", "fr": "Allemagne", "ja": "ドイツ連邦共和国"},
+		Latitude:       51.2993,
+		Longitude:      9.491,
+		TimeZone:       "Europe/Berlin",
+	}},
+}
+
+// Bytes returns the database in the MaxMind DB format.
+func Bytes() []byte {
+	w := dbbuild.NewWriter(dbbuild.Metadata{
+		DatabaseType: "freegeoip-Test-City",
+		Description:  map[string]string{"en": "freegeoip test database"},
+		Languages:    Languages,
+		BuildEpoch:   BuildDate,
+	})
+	for _, n := range Networks {
+		_, network, err := net.ParseCIDR(n.CIDR)
+		if err != nil {
+			panic(err)
+		}
+		err = w.Insert(network, n.Location.Record())
+		if err != nil {
+			panic(err)
+		}
+	}
+	var b bytes.Buffer
+	_, err := w.WriteTo(&b)
+	if err != nil {
+		panic(err)
+	}
+	return b.Bytes()
+}
+
+// Gzip returns the database compressed with gzip, as expected by
+// freegeoip.Open and OpenURL.
+func Gzip() []byte {
+	var b bytes.Buffer
+	gz := gzip.NewWriter(&b)
+	gz.Write(Bytes())
+	gz.Close()
+	return b.Bytes()
+}
+
+// WriteFile writes the compressed database to the named file.
+func WriteFile(name string) error {
+	return ioutil.WriteFile(name, Gzip(), 0644)
+}
@@ -0,0 +1,421 @@
+// Copyright 2009 The freegeoip authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package freegeoip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"reflect"
+	"strconv"
+	"time"
+)
+
+// Column positions of the IP2Location BIN fields by database type,
+// DB1 to DB26. Position 1 is the first address of the row, 0 means the
+// field is not available in that type.
+var (
+	ip2lCountry   = [27]uint8{0, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2}
+	ip2lRegion    = [27]uint8{0, 0, 0, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3}
+	ip2lCity      = [27]uint8{0, 0, 0, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4}
+	ip2lLatitude  = [27]uint8{0, 0, 0, 0, 0, 5, 5, 0, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5}
+	ip2lLongitude = [27]uint8{0, 0, 0, 0, 0, 6, 6, 0, 6, 6, 6, 6, 6, 6, 6, 6, 6, 6, 6, 6, 6, 6, 6, 6, 6, 6, 6}
+	ip2lZipCode   = [27]uint8{0, 0, 0, 0, 0, 0, 0, 0, 0, 7, 7, 7, 7, 0, 7, 7, 7, 0, 7, 0, 7, 7, 7, 0, 7, 7, 7}
+	ip2lTimeZone  = [27]uint8{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 8, 8, 7, 8, 8, 8, 7, 8, 0, 8, 8, 8, 0, 8, 8, 8}
+)
+
+// Size of the IP2Location BIN header.
+const ip2lHeaderSize = 64
+
+// ip2locationReader is a reader for the IP2Location BIN format. Records
+// are presented with the layout of the MaxMind DB City databases, with
+// names in English and time zones as UTC offsets, e.g. "-05:00".
+type ip2locationReader struct {
+	b         []byte
+	dbType    int
+	columns   uint32
+	date      time.Time
+	ipv4Count uint32
+	ipv4Addr  uint32
+	ipv6Count uint32
+	ipv6Addr  uint32
+	ipv4Index uint32
+	ipv6Index uint32
+}
+
+// isIP2Location reports whether b looks like an IP2Location BIN file.
+// MaxMind DB files have no header, so only the BIN header is checked.
+func isIP2Location(b []byte) bool {
+	if len(b) < ip2lHeaderSize || bytes.Contains(b, mmdbMetadataMarker) {
+		return false
+	}
+	dbType, columns, month, day := int(b[0]), b[1], b[3], b[4]
+	return dbType > 0 && dbType < len(ip2lCountry) &&
+		columns >= 2 && month >= 1 && month <= 12 && day >= 1 && day <= 31
+}
+
+var mmdbMetadataMarker = []byte("\xAB\xCD\xEFMaxMind.com")
+
+func newIP2LocationReader(b []byte) (*ip2locationReader, error) {
+	r := &ip2locationReader{
+		b:       b,
+		dbType:  int(b[0]),
+		columns: uint32(b[1]),
+		date:    time.Date(2000+int(b[2]), time.Month(b[3]), int(b[4]), 0, 0, 0, 0, time.UTC),
+	}
+	var err error
+	for _, f := range []struct {
+		v   *uint32
+		pos uint32
+	}{
+		{&r.ipv4Count, 6},
+		{&r.ipv4Addr, 10},
+		{&r.ipv6Count, 14},
+		{&r.ipv6Addr, 18},
+		{&r.ipv4Index, 22},
+		{&r.ipv6Index, 26},
+	} {
+		*f.v, err = r.uint32(f.pos)
+		if err != nil {
+			return nil, err
+		}
+	}
+	rows := []struct{ count, addr, size uint32 }{
+		{r.ipv4Count, r.ipv4Addr, r.columns * 4},
+		{r.ipv6Count, r.ipv6Addr, 16 + (r.columns-1)*4},
+	}
+	for _, t := range rows {
+		if t.count > 0 && uint64(t.addr)+uint64(t.count)*uint64(t.size) > uint64(len(b)) {
+			return nil, errors.New("invalid IP2Location BIN file: truncated")
+		}
+	}
+	return r, nil
+}
+
+var errIP2LocationBounds = errors.New("invalid IP2Location BIN file: offset out of bounds")
+
+// uint32 reads a little endian integer at the 1-based position.
+func (r *ip2locationReader) uint32(pos uint32) (uint32, error) {
+	if pos == 0 || uint64(pos)+3 > uint64(len(r.b)) {
+		return 0, errIP2LocationBounds
+	}
+	return binary.LittleEndian.Uint32(r.b[pos-1:]), nil
+}
+
+// uint128 reads a little endian 128 bit integer at the 1-based position
+// as its high and low halves.
+func (r *ip2locationReader) uint128(pos uint32) (hi, lo uint64, err error) {
+	if pos == 0 || uint64(pos)+15 > uint64(len(r.b)) {
+		return 0, 0, errIP2LocationBounds
+	}
+	lo = binary.LittleEndian.Uint64(r.b[pos-1:])
+	hi = binary.LittleEndian.Uint64(r.b[pos+7:])
+	return hi, lo, nil
+}
+
+// string reads a length prefixed string at the 0-based offset.
+func (r *ip2locationReader) string(off uint32) (string, error) {
+	if uint64(off) >= uint64(len(r.b)) {
+		return "", errIP2LocationBounds
+	}
+	end := uint64(off) + 1 + uint64(r.b[off])
+	if end > uint64(len(r.b)) {
+		return "", errIP2LocationBounds
+	}
+	return string(r.b[off+1 : end]), nil
+}
+
+// Lookup stores the record of the given address into result, see the
+// Lookup method of DB.
+func (r *ip2locationReader) Lookup(addr net.IP, result interface{}) error {
+	row, err := r.find(addr)
+	if err != nil || row == 0 {
+		return err
+	}
+	record, err := r.record(row, addr.To4() == nil)
+	if err != nil {
+		return err
+	}
+	return decodeRecord(record, result)
+}
+
+// find returns the 1-based position of the row containing addr, after
+// its first address, or 0 if there is none.
+func (r *ip2locationReader) find(addr net.IP) (uint32, error) {
+	var hi, lo uint64 // Address as a 128 bit integer.
+	var count, base, index, size uint32
+	if ip4 := addr.To4(); ip4 != nil {
+		lo = uint64(binary.BigEndian.Uint32(ip4))
+		count, base, index, size = r.ipv4Count, r.ipv4Addr, r.ipv4Index, r.columns*4
+		if lo == math.MaxUint32 {
+			lo-- // The last row starts at the maximum address.
+		}
+	} else if ip6 := addr.To16(); ip6 != nil {
+		hi = binary.BigEndian.Uint64(ip6[:8])
+		lo = binary.BigEndian.Uint64(ip6[8:])
+		count, base, index, size = r.ipv6Count, r.ipv6Addr, r.ipv6Index, 16+(r.columns-1)*4
+		if hi == math.MaxUint64 && lo == math.MaxUint64 {
+			lo--
+		}
+	} else {
+		return 0, fmt.Errorf("invalid IP address: %v", addr)
+	}
+	if count == 0 {
+		return 0, nil
+	}
+	low, high := uint32(0), count
+	if index > 0 {
+		// The index has the range of rows of every /16 for IPv4,
+		// or of every first 16 bits for IPv6.
+		prefix := uint32(lo >> 16)
+		if addr.To4() == nil {
+			prefix = uint32(hi >> 48)
+		}
+		var err error
+		if low, err = r.uint32(index + prefix*8); err != nil {
+			return 0, err
+		}
+		if high, err = r.uint32(index + prefix*8 + 4); err != nil {
+			return 0, err
+		}
+	}
+	v6 := addr.To4() == nil
+	read := func(pos uint32) (uint64, uint64, error) {
+		if v6 {
+			return r.uint128(pos)
+		}
+		v, err := r.uint32(pos)
+		return 0, uint64(v), err
+	}
+	less := func(h1, l1, h2, l2 uint64) bool {
+		return h1 < h2 || (h1 == h2 && l1 < l2)
+	}
+	if high >= count {
+		high = count - 1 // Row count only has the end of the last range.
+	}
+	for low <= high {
+		mid := low + (high-low)/2
+		pos := base + mid*size
+		fromHi, fromLo, err := read(pos)
+		if err != nil {
+			return 0, err
+		}
+		toHi, toLo, err := read(pos + size)
+		if err != nil {
+			return 0, err
+		}
+		switch {
+		case less(hi, lo, fromHi, fromLo):
+			if mid == 0 {
+				return 0, nil
+			}
+			high = mid - 1
+		case !less(hi, lo, toHi, toLo):
+			low = mid + 1
+		default:
+			if v6 {
+				pos += 12 // Columns are after the 16 byte address.
+			}
+			return pos, nil
+		}
+	}
+	return 0, nil
+}
+
+// record reads the fields of the row at pos into a record with the
+// layout of the MaxMind DB City databases.
+func (r *ip2locationReader) record(pos uint32, v6 bool) (map[string]interface{}, error) {
+	column := func(positions [27]uint8) (uint32, bool) {
+		p := uint32(positions[r.dbType])
+		if p == 0 || p > r.columns {
+			return 0, false
+		}
+		return pos + (p-1)*4, true
+	}
+	str := func(positions [27]uint8, offset uint32) (string, error) {
+		col, ok := column(positions)
+		if !ok {
+			return "", nil
+		}
+		ptr, err := r.uint32(col)
+		if err != nil {
+			return "", err
+		}
+		s, err := r.string(ptr + offset)
+		if s == "-" {
+			s = "" // Unknown.
+		}
+		return s, err
+	}
+	float := func(positions [27]uint8) (float64, error) {
+		col, ok := column(positions)
+		if !ok {
+			return 0, nil
+		}
+		v, err := r.uint32(col)
+		return float64(math.Float32frombits(v)), err
+	}
+
+	var err error
+	var f [6]string
+	for i, c := range []struct {
+		positions [27]uint8
+		offset    uint32
+	}{
+		{ip2lCountry, 0},
+		{ip2lCountry, 3}, // Country name follows the 2 letter code.
+		{ip2lRegion, 0},
+		{ip2lCity, 0},
+		{ip2lZipCode, 0},
+		{ip2lTimeZone, 0},
+	} {
+		f[i], err = str(c.positions, c.offset)
+		if err != nil {
+			return nil, err
+		}
+	}
+	lat, err := float(ip2lLatitude)
+	if err != nil {
+		return nil, err
+	}
+	lon, err := float(ip2lLongitude)
+	if err != nil {
+		return nil, err
+	}
+
+	names := func(name string) map[string]interface{} {
+		return map[string]interface{}{"names": map[string]interface{}{"en": name}}
+	}
+	record := make(map[string]interface{})
+	if f[0] != "" {
+		country := names(f[1])
+		country["iso_code"] = f[0]
+		record["country"] = country
+	}
+	if f[2] != "" {
+		record["subdivisions"] = []interface{}{names(f[2])}
+	}
+	if f[3] != "" {
+		record["city"] = names(f[3])
+	}
+	if f[4] != "" {
+		record["postal"] = map[string]interface{}{"code": f[4]}
+	}
+	location := map[string]interface{}{
+		"latitude":  roundFloat32(lat),
+		"longitude": roundFloat32(lon),
+	}
+	if f[5] != "" {
+		location["time_zone"] = f[5]
+	}
+	record["location"] = location
+	return record, nil
+}
+
+// roundFloat32 drops the noise of widening a float32 coordinate, e.g.
+// 37.386 rather than 37.38600158691406.
+func roundFloat32(v float64) float64 {
+	v, _ = strconv.ParseFloat(strconv.FormatFloat(v, 'f', -1, 32), 64)
+	return v
+}
+
+func (r *ip2locationReader) Close() error {
+	return nil
+}
+
+func (r *ip2locationReader) buildDate() time.Time {
+	return r.date
+}
+
+func (r *ip2locationReader) languages() []string {
+	return []string{"en"}
+}
+
+// decodeRecord stores a record made of maps, slices, strings and
+// numbers into result, which must be a pointer to a value with the
+// layout described by maxminddb struct tags.
+func decodeRecord(record interface{}, result interface{}) error {
+	rv := reflect.ValueOf(result)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return errors.New("result param must be a pointer")
+	}
+	return decodeValue(record, rv.Elem())
+}
+
+func decodeValue(data interface{}, v reflect.Value) error {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return decodeValue(data, v.Elem())
+	case reflect.Interface:
+		if v.NumMethod() == 0 {
+			v.Set(reflect.ValueOf(data))
+			return nil
+		}
+	}
+	switch d := data.(type) {
+	case map[string]interface{}:
+		switch v.Kind() {
+		case reflect.Struct:
+			t := v.Type()
+			for i := 0; i < t.NumField(); i++ {
+				field := t.Field(i)
+				name := field.Tag.Get("maxminddb")
+				if name == "" {
+					name = field.Name
+				}
+				if value, ok := d[name]; ok && field.PkgPath == "" {
+					if err := decodeValue(value, v.Field(i)); err != nil {
+						return err
+					}
+				}
+			}
+			return nil
+		case reflect.Map:
+			if v.Type().Key().Kind() != reflect.String {
+				break
+			}
+			if v.IsNil() {
+				v.Set(reflect.MakeMap(v.Type()))
+			}
+			for k, value := range d {
+				elem := reflect.New(v.Type().Elem()).Elem()
+				if err := decodeValue(value, elem); err != nil {
+					return err
+				}
+				v.SetMapIndex(reflect.ValueOf(k).Convert(v.Type().Key()), elem)
+			}
+			return nil
+		}
+	case []interface{}:
+		if v.Kind() == reflect.Slice {
+			s := reflect.MakeSlice(v.Type(), len(d), len(d))
+			for i, value := range d {
+				if err := decodeValue(value, s.Index(i)); err != nil {
+					return err
+				}
+			}
+			v.Set(s)
+			return nil
+		}
+	case string:
+		if v.Kind() == reflect.String {
+			v.SetString(d)
+			return nil
+		}
+	case float64:
+		switch v.Kind() {
+		case reflect.Float32, reflect.Float64:
+			v.SetFloat(d)
+			return nil
+		}
+	}
+	return fmt.Errorf("cannot decode %T into %s", data, v.Type())
+}
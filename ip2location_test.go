@@ -0,0 +1,315 @@
+// Copyright 2009 The freegeoip authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package freegeoip
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"net"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// ip2lRow is a range of an IP2Location DB11 test file.
+type ip2lRow struct {
+	from                        net.IP
+	country, name, region, city string
+	lat, lon                    float32
+	zip, tz                     string
+}
+
+// ip2lPrefix returns the first 16 bits of an address of ip2lRow, the
+// key of the indexes.
+func ip2lPrefix(from net.IP, v6 bool) uint32 {
+	if v6 {
+		return uint32(binary.BigEndian.Uint16(from.To16()))
+	}
+	return uint32(binary.BigEndian.Uint16(from.To4()))
+}
+
+// ip2lIndex returns the index of the first 16 bits of the addresses of
+// rows, the first and last row of each prefix as official files do.
+func ip2lIndex(rows []ip2lRow, v6 bool) []byte {
+	var low, high [1 << 16]uint32
+	var seen [1 << 16]bool
+	for i, r := range rows {
+		last := uint32(1<<16 - 1)
+		if i+1 < len(rows) {
+			// The row ends before the next one starts, which may be
+			// the first address of a prefix.
+			next := rows[i+1].from.To16()
+			last = ip2lPrefix(next, v6)
+			rest := next[2:]
+			if !v6 {
+				rest = next[14:]
+			}
+			if bytes.Count(rest, []byte{0}) == len(rest) {
+				last--
+			}
+		}
+		for p := ip2lPrefix(r.from, v6); p <= last; p++ {
+			if !seen[p] {
+				low[p], seen[p] = uint32(i), true
+			}
+			high[p] = uint32(i)
+		}
+	}
+	b := make([]byte, 8<<16)
+	for p := range low {
+		binary.LittleEndian.PutUint32(b[p*8:], low[p])
+		binary.LittleEndian.PutUint32(b[p*8+4:], high[p])
+	}
+	return b
+}
+
+// writeIP2LocationDB11 returns a DB11 BIN file with the given IPv4 and
+// IPv6 ranges, each ending where the next one starts, and their
+// indexes if indexed.
+func writeIP2LocationDB11(v4, v6 []ip2lRow, indexed bool) []byte {
+	const columns = 8
+	v4Size, v6Size := columns*4, 16+(columns-1)*4
+	v4Addr := 64
+	v6Addr := v4Addr + (len(v4)+1)*v4Size
+	strAddr := v6Addr + (len(v6)+1)*v6Size
+	var v4Index, v6Index int
+	if indexed {
+		v4Index, v6Index = strAddr+1, strAddr+1+8<<16
+		strAddr += 2 * 8 << 16
+	}
+
+	var strs bytes.Buffer
+	str := func(s string) uint32 {
+		off := uint32(strAddr + strs.Len())
+		strs.WriteByte(byte(len(s)))
+		strs.WriteString(s)
+		return off
+	}
+	// The country name follows a 2 byte code, "-" for unknown.
+	country := func(code, name string) uint32 {
+		off := str(code)
+		strs.Write(make([]byte, 2-len(code)))
+		str(name)
+		return off
+	}
+	var rows bytes.Buffer
+	le := func(v interface{}) { binary.Write(&rows, binary.LittleEndian, v) }
+	writeRows := func(rs []ip2lRow, v6 bool) {
+		for i := 0; i <= len(rs); i++ {
+			var from net.IP
+			if i < len(rs) {
+				from = rs[i].from
+			}
+			if v6 {
+				var hi, lo uint64
+				if from == nil {
+					hi, lo = math.MaxUint64, math.MaxUint64
+				} else {
+					ip := from.To16()
+					hi, lo = binary.BigEndian.Uint64(ip), binary.BigEndian.Uint64(ip[8:])
+				}
+				le(lo)
+				le(hi)
+			} else if from == nil {
+				le(uint32(math.MaxUint32))
+			} else {
+				le(binary.BigEndian.Uint32(from.To4()))
+			}
+			var r ip2lRow
+			if i < len(rs) {
+				r = rs[i]
+			}
+			le(country(r.country, r.name))
+			le(str(r.region))
+			le(str(r.city))
+			le(r.lat)
+			le(r.lon)
+			le(str(r.zip))
+			le(str(r.tz))
+		}
+	}
+	writeRows(v4, false)
+	writeRows(v6, true)
+	if indexed {
+		rows.Write(ip2lIndex(v4, false))
+		rows.Write(ip2lIndex(v6, true))
+	}
+
+	header := make([]byte, 64)
+	header[0], header[1] = 11, columns
+	header[2], header[3], header[4] = 22, 4, 1 // 2022-04-01
+	for i, v := range []int{len(v4), v4Addr + 1, len(v6), v6Addr + 1, v4Index, v6Index} {
+		binary.LittleEndian.PutUint32(header[5+i*4:], uint32(v))
+	}
+	return append(append(header, rows.Bytes()...), strs.Bytes()...)
+}
+
+func testIP2LocationFile(t *testing.T) string {
+	unknown := ip2lRow{country: "-", name: "-", region: "-", city: "-", zip: "-", tz: "-"}
+	us := ip2lRow{
+		country: "US", name: "United States of America",
+		region: "California", city: "Mountain View",
+		lat: 37.386, lon: -122.0838, zip: "94035", tz: "-07:00",
+	}
+	at := func(r ip2lRow, ip string) ip2lRow {
+		r.from = net.ParseIP(ip)
+		return r
+	}
+	b := writeIP2LocationDB11(
+		[]ip2lRow{at(unknown, "0.0.0.0"), at(us, "8.8.8.0"), at(unknown, "8.8.9.0")},
+		[]ip2lRow{at(unknown, "::"), at(us, "2001:4860::"), at(unknown, "2001:4861::")},
+		false,
+	)
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write(b)
+	gz.Close()
+	name := filepath.Join(t.TempDir(), "db.gz")
+	if err := ioutil.WriteFile(name, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+func TestIP2Location(t *testing.T) {
+	db, err := Open(testIP2LocationFile(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, ok := db.reader.(*ip2locationReader); !ok {
+		t.Fatalf("Unexpected reader: %T", db.reader)
+	}
+	want := time.Date(2022, 4, 1, 0, 0, 0, 0, time.UTC)
+	if !db.BuildDate().Equal(want) {
+		t.Fatalf("Unexpected build date: %v", db.BuildDate())
+	}
+	for _, ip := range []string{"8.8.8.8", "8.8.8.0", "8.8.8.255", "2001:4860::8888"} {
+		var q DefaultQuery
+		if err := db.Lookup(net.ParseIP(ip), &q); err != nil {
+			t.Fatal(err)
+		}
+		switch {
+		case q.Country.ISOCode != "US",
+			q.Country.Names["en"] != "United States of America",
+			len(q.Region) != 1 || q.Region[0].Names["en"] != "California",
+			q.City.Names["en"] != "Mountain View",
+			q.Location.Latitude != 37.386,
+			q.Location.Longitude != -122.0838,
+			q.Location.TimeZone != "-07:00",
+			q.Postal.Code != "94035":
+			t.Fatalf("Unexpected record for %s: %+v", ip, q)
+		}
+	}
+	for _, ip := range []string{"1.2.3.4", "8.8.9.0", "255.255.255.255", "::1"} {
+		var q DefaultQuery
+		if err := db.Lookup(net.ParseIP(ip), &q); err != nil {
+			t.Fatal(err)
+		}
+		if q.Country.ISOCode != "" || q.City.Names != nil {
+			t.Fatalf("Unexpected record for %s: %+v", ip, q)
+		}
+	}
+}
+
+func TestIsIP2Location(t *testing.T) {
+	b, err := ioutil.ReadFile(testFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gz, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mmdb, err := ioutil.ReadAll(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if isIP2Location(mmdb) {
+		t.Fatal("Unexpected MaxMind DB detected as IP2Location")
+	}
+	if !isIP2Location(writeIP2LocationDB11(nil, nil, false)) {
+		t.Fatal("IP2Location BIN file not detected")
+	}
+}
+
+func TestIP2LocationIndex(t *testing.T) {
+	row := func(ip, country string) ip2lRow {
+		return ip2lRow{from: net.ParseIP(ip), country: country, name: country, region: "-", city: "-", zip: "-", tz: "-"}
+	}
+	v4 := []ip2lRow{
+		row("0.0.0.0", "-"),
+		row("8.8.8.0", "US"),
+		row("8.8.9.0", "-"),
+		row("8.9.255.0", "DE"), // Spans two /16.
+		row("8.10.0.128", "-"),
+		row("8.11.0.0", "FR"),
+		row("8.12.0.0", "-"),
+		row("200.1.2.0", "VE"),
+		row("200.1.3.0", "-"),
+	}
+	v6 := []ip2lRow{
+		row("::", "-"),
+		row("2001:4860::", "US"),
+		row("2001:4861::", "-"),
+		row("2a01:4f8::", "DE"),
+		row("2a01:4f9::", "-"),
+		row("2a02::", "FR"),
+		row("2a03::", "-"),
+	}
+	indexed, err := newIP2LocationReader(writeIP2LocationDB11(v4, v6, true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if indexed.ipv4Index == 0 || indexed.ipv6Index == 0 {
+		t.Fatal("Unexpected file without an index")
+	}
+	plain, err := newIP2LocationReader(writeIP2LocationDB11(v4, v6, false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ips := []string{
+		"0.0.0.0", "1.2.3.4", "8.8.7.255", "8.8.8.0", "8.8.8.8", "8.8.8.255", "8.8.9.0",
+		"8.9.254.255", "8.9.255.0", "8.10.0.0", "8.10.0.127", "8.10.0.128",
+		"8.10.255.255", "8.11.0.0", "8.11.255.255", "8.12.0.0", "200.1.2.3",
+		"200.1.3.0", "255.255.255.255",
+		"::", "::1", "2001:485f:ffff::", "2001:4860::", "2001:4860::8888",
+		"2001:4860:ffff::1", "2001:4861::", "2a01:4f8::1", "2a01:4f9::",
+		"2a02::", "2a02:ffff::1", "2a03::", "ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff",
+	}
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 1000; i++ {
+		ip := make(net.IP, 4)
+		if i%2 == 1 {
+			ip = make(net.IP, 16)
+		}
+		rnd.Read(ip)
+		ips = append(ips, ip.String())
+	}
+	found := 0
+	for _, ip := range ips {
+		var have, want DefaultQuery
+		if err := indexed.Lookup(net.ParseIP(ip), &have); err != nil {
+			t.Fatalf("%s: %v", ip, err)
+		}
+		if err := plain.Lookup(net.ParseIP(ip), &want); err != nil {
+			t.Fatalf("%s: %v", ip, err)
+		}
+		if !reflect.DeepEqual(have, want) {
+			t.Fatalf("%s: indexed lookup %+v, want %+v", ip, have, want)
+		}
+		if have.Country.ISOCode != "" {
+			found++
+		}
+	}
+	if found < 10 {
+		t.Fatalf("Unexpected lookups: %d found", found)
+	}
+}
@@ -0,0 +1,97 @@
+// Copyright 2009 The freegeoip authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package freegeoip
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+)
+
+// ChecksumHeader is the HTTP header with the checksum of a database
+// file served to peers, as returned by DB.Checksum.
+const ChecksumHeader = "X-Database-Checksum"
+
+var errNoPeer = errors.New("no peer could provide the database")
+
+// Maximum time to download the database from a peer, which is usually
+// on the same network.
+var peerTimeout = time.Minute
+
+// WithPeers makes OpenURL download the database from sibling instances
+// before falling back to its URL. Peers are tried in order, and each
+// URL must serve a gzipped database file with its checksum in the
+// ChecksumHeader, as the freegeoip server does with -serve-db.
+//
+// Files whose checksum doesn't match are discarded. Files from peers
+// are validated like any other, see WithCanary. Each peer has
+// peerTimeout to send the database before the next one is tried.
+func WithPeers(urls ...string) Option {
+	return func(db *DB) {
+		db.peers = urls
+	}
+}
+
+// WithPeerSecret sets the secret sent to peers as a bearer token in the
+// Authorization header, as required by the freegeoip server.
+func WithPeerSecret(secret string) Option {
+	return func(db *DB) {
+		db.peerSecret = secret
+	}
+}
+
+// WithCacheFile sets the local copy of the database downloaded by
+// OpenURL, ./db.gz by default.
+func WithCacheFile(name string) Option {
+	return func(db *DB) {
+		db.cacheFile = name
+	}
+}
+
+// downloadPeers returns a temporary file with the database downloaded
+// from the first peer that provides a valid one.
+func (db *DB) downloadPeers() (string, error) {
+	for _, peer := range db.peers {
+		tmpfile, err := db.downloadPeer(peer)
+		if err == nil {
+			db.sendInfo(fmt.Sprintf("downloaded db from peer %s", peer))
+			return tmpfile, nil
+		}
+		db.sendInfo(fmt.Sprintf("peer %s failed: %v", peer, err))
+	}
+	return "", errNoPeer
+}
+
+func (db *DB) downloadPeer(url string) (string, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return "", err
+	}
+	if db.peerSecret != "" {
+		req.Header.Set("Authorization", "Bearer "+db.peerSecret)
+	}
+	tmpfile, header, err := db.fetch(req, peerTimeout)
+	if err != nil {
+		return "", err
+	}
+	want := header.Get(ChecksumHeader)
+	if want == "" {
+		os.Remove(tmpfile)
+		return "", fmt.Errorf("missing %s header", ChecksumHeader)
+	}
+	reader, checksum, err := db.newReader(tmpfile)
+	if err != nil {
+		os.Remove(tmpfile)
+		return "", err
+	}
+	reader.Close()
+	if checksum != want {
+		os.Remove(tmpfile)
+		return "", fmt.Errorf("checksum mismatch: got %s, want %s", checksum, want)
+	}
+	return tmpfile, nil
+}
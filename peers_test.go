@@ -0,0 +1,92 @@
+// Copyright 2009 The freegeoip authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package freegeoip
+
+import (
+	"crypto/md5"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/fiorix/freegeoip/internal/testdb"
+)
+
+func TestDownloadPeers(t *testing.T) {
+	checksum := fmt.Sprintf("%x", md5.Sum(testdb.Bytes()))
+	serve := func(checksum string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if checksum != "" {
+				w.Header().Set(ChecksumHeader, checksum)
+			}
+			w.Write(testdb.Gzip())
+		}
+	}
+	var hits int
+	mux := http.NewServeMux()
+	mux.HandleFunc("/bad-checksum", serve("0123456789abcdef0123456789abcdef"))
+	mux.HandleFunc("/no-checksum", serve(""))
+	mux.HandleFunc("/down", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "down", http.StatusServiceUnavailable)
+	})
+	mux.HandleFunc("/good", func(w http.ResponseWriter, r *http.Request) {
+		hits++
+		serve(checksum)(w, r)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	db := &DB{notifyInfo: make(chan string, 10)}
+	db.peers = []string{srv.URL + "/down", srv.URL + "/bad-checksum", srv.URL + "/no-checksum"}
+	if _, err := db.downloadPeers(); err != errNoPeer {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for len(db.notifyInfo) > 0 {
+		t.Log(<-db.notifyInfo)
+	}
+
+	db.peers = append(db.peers, srv.URL+"/good")
+	tmpfile, err := db.downloadPeers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tmpfile)
+	if hits != 1 {
+		t.Fatalf("Unexpected hits: %d", hits)
+	}
+}
+
+func TestDownloadPeersTimeout(t *testing.T) {
+	defer func(d time.Duration) { peerTimeout = d }(peerTimeout)
+	peerTimeout = 50 * time.Millisecond
+	checksum := fmt.Sprintf("%x", md5.Sum(testdb.Bytes()))
+	release := make(chan struct{})
+	var auth string
+	mux := http.NewServeMux()
+	mux.HandleFunc("/hung", func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	})
+	mux.HandleFunc("/good", func(w http.ResponseWriter, r *http.Request) {
+		auth = r.Header.Get("Authorization")
+		w.Header().Set(ChecksumHeader, checksum)
+		w.Write(testdb.Gzip())
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	defer close(release)
+
+	db := &DB{notifyInfo: make(chan string, 10), peerSecret: "s3cret"}
+	db.peers = []string{srv.URL + "/hung", srv.URL + "/good"}
+	tmpfile, err := db.downloadPeers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tmpfile)
+	if auth != "Bearer s3cret" {
+		t.Fatalf("Unexpected Authorization header: %q", auth)
+	}
+}
@@ -0,0 +1,35 @@
+// Copyright 2009 The freegeoip authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package freegeoip
+
+import (
+	"net"
+	"time"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// reader is a database in one of the supported formats: MaxMind DB
+// (as published by MaxMind and db-ip) and IP2Location BIN. Lookups in
+// any format store results with the layout of maxminddb tags.
+type reader interface {
+	Lookup(addr net.IP, result interface{}) error
+	Close() error
+	buildDate() time.Time
+	languages() []string
+}
+
+// mmdbReader is a reader for the MaxMind DB format.
+type mmdbReader struct {
+	*maxminddb.Reader
+}
+
+func (r mmdbReader) buildDate() time.Time {
+	return time.Unix(int64(r.Metadata.BuildEpoch), 0).UTC()
+}
+
+func (r mmdbReader) languages() []string {
+	return r.Metadata.Languages
+}
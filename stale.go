@@ -0,0 +1,87 @@
+// Copyright 2009 The freegeoip authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package freegeoip
+
+import (
+	"fmt"
+	"time"
+)
+
+// Interval between staleness checks of a database that is not
+// reloaded. It is shortened for small maximum ages.
+var staleCheckInterval = time.Hour
+
+// WithMaxAge reports the database as stale once it is older than
+// maxAge, see DB.Stale. A StaleError is sent to NotifyError every time
+// the database becomes stale.
+func WithMaxAge(maxAge time.Duration) Option {
+	return func(db *DB) {
+		db.maxAge = maxAge
+		db.staleCheck = make(chan struct{}, 1)
+	}
+}
+
+// StaleError is the error sent to NotifyError when the database becomes
+// older than the maximum age set by WithMaxAge.
+type StaleError struct {
+	Date   time.Time // Build date, or modification date of the file.
+	MaxAge time.Duration
+}
+
+func (e *StaleError) Error() string {
+	return fmt.Sprintf("database from %s is older than %s",
+		e.Date.Format("2006-01-02"), e.MaxAge)
+}
+
+// Stale reports whether the database is older than the maximum age set
+// by WithMaxAge. The age is that of the build date in the database
+// metadata, or of the database file when the build date is unknown. A
+// database that is not loaded is not stale.
+func (db *DB) Stale() bool {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.stale(time.Now())
+}
+
+func (db *DB) stale(now time.Time) bool {
+	date := db.date()
+	return db.maxAge > 0 && !date.IsZero() && now.Sub(date) > db.maxAge
+}
+
+// date returns the date the age of the database is measured from. The
+// lock must be held.
+func (db *DB) date() time.Time {
+	if db.buildDate.Unix() > 0 {
+		return db.buildDate
+	}
+	return db.lastUpdated
+}
+
+// watchStale sends a StaleError when the database becomes stale, after
+// it is loaded or as it ages.
+func (db *DB) watchStale() {
+	interval := staleCheckInterval
+	if db.maxAge/10 < interval {
+		interval = db.maxAge/10 + time.Millisecond
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	stale := false
+	for {
+		select {
+		case <-db.staleCheck:
+		case <-ticker.C:
+		case <-db.notifyQuit:
+			return
+		}
+		db.mu.RLock()
+		now, date := db.stale(time.Now()), db.date()
+		db.mu.RUnlock()
+		if now && !stale {
+			db.reportError(&StaleError{Date: date, MaxAge: db.maxAge})
+		}
+		stale = now
+	}
+}
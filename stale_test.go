@@ -0,0 +1,58 @@
+// Copyright 2009 The freegeoip authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package freegeoip
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fiorix/freegeoip/internal/testdb"
+)
+
+func TestStale(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "db.gz")
+	err := testdb.WriteFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := Open(file, WithMaxAge(24*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if !db.Stale() {
+		t.Fatal("Unexpected fresh database built on", db.BuildDate())
+	}
+	select {
+	case err := <-db.NotifyError():
+		serr, ok := err.(*StaleError)
+		if !ok {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if !serr.Date.Equal(testdb.BuildDate) {
+			t.Fatalf("Unexpected date: %v", serr.Date)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timed out")
+	}
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.stale(testdb.BuildDate.Add(23 * time.Hour)) {
+		t.Fatal("Unexpected stale database before its maximum age")
+	}
+}
+
+func TestStaleDisabled(t *testing.T) {
+	db, err := Open(testFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if db.Stale() {
+		t.Fatal("Unexpected stale database without a maximum age")
+	}
+}
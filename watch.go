@@ -0,0 +1,232 @@
+// Copyright 2009 The freegeoip authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package freegeoip
+
+import (
+	"crypto/md5"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// Interval of the polling watcher when fsnotify is not available.
+var defaultPollInterval = 30 * time.Second
+
+// WithPolling makes the DB watch its file by polling it at the given
+// interval instead of using fsnotify, e.g. on network filesystems that
+// don't deliver change events.
+func WithPolling(interval time.Duration) Option {
+	return func(db *DB) {
+		db.pollInterval = interval
+	}
+}
+
+// watcher notifies when the database file may have changed.
+type watcher interface {
+	Changes() <-chan struct{}
+	Close() error
+}
+
+// notify sends a non-blocking notification, coalescing bursts.
+func notify(c chan struct{}) {
+	select {
+	case c <- struct{}{}:
+	default:
+	}
+}
+
+// Time to wait for a burst of fsnotify events to settle.
+var debounceDelay = 100 * time.Millisecond
+
+// fileState tracks the content a file name resolves to. Symlinks are
+// followed, so a file swapped by replacing a symlink (e.g. the ..data
+// link of Kubernetes volumes) is detected like a file written in place.
+type fileState struct {
+	target   string // File name with symlinks resolved.
+	size     int64
+	modTime  time.Time
+	checksum string
+}
+
+// update reports whether the file content differs from the last call.
+// The checksum is only computed when the target, size or modification
+// time changes, and identical content is not reported as a change.
+func (s *fileState) update(file string) bool {
+	target, err := filepath.EvalSymlinks(file)
+	if err != nil {
+		// Missing or dangling, check again when it shows up.
+		s.target = ""
+		return false
+	}
+	stat, err := os.Stat(target)
+	if err != nil {
+		s.target = ""
+		return false
+	}
+	if target == s.target && stat.Size() == s.size && stat.ModTime().Equal(s.modTime) {
+		return false
+	}
+	s.target, s.size, s.modTime = target, stat.Size(), stat.ModTime()
+	sum, err := fileChecksum(target)
+	if err != nil || sum == s.checksum {
+		return false
+	}
+	s.checksum = sum
+	return true
+}
+
+// fsWatcher is a watcher based on fsnotify events. It watches the
+// directory of the file and the directory of its resolved target, and
+// checks the content after events settle.
+type fsWatcher struct {
+	file    string
+	dir     string
+	watcher *fsnotify.Watcher
+	changes chan struct{}
+	state   fileState
+	target  string // Directory of the resolved target being watched.
+}
+
+func newFSWatcher(file, dir string) (*fsWatcher, error) {
+	fw, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	err = fw.Add(dir)
+	if err != nil {
+		fw.Close()
+		return nil, err
+	}
+	w := &fsWatcher{
+		file:    file,
+		dir:     filepath.Clean(dir),
+		watcher: fw,
+		changes: make(chan struct{}, 1),
+	}
+	w.state.update(file) // Record the initial state.
+	w.watchTarget()
+	go w.run()
+	return w, nil
+}
+
+func (w *fsWatcher) run() {
+	timer := time.NewTimer(debounceDelay)
+	timer.Stop()
+	defer timer.Stop()
+	for {
+		select {
+		case _, ok := <-w.watcher.Events:
+			if !ok {
+				return
+			}
+			// Any event in the watched directories may swap
+			// the file, wait for the burst to end and compare.
+			timer.Reset(debounceDelay)
+		case _, ok := <-w.watcher.Errors:
+			if !ok {
+				return
+			}
+		case <-timer.C:
+			if w.state.update(w.file) {
+				notify(w.changes)
+			}
+			w.watchTarget()
+		}
+	}
+}
+
+// watchTarget follows the directory of the resolved target, when it is
+// not the directory of the file itself.
+func (w *fsWatcher) watchTarget() {
+	dir := ""
+	if w.state.target != "" {
+		dir = filepath.Dir(w.state.target)
+		if rel, err := filepath.EvalSymlinks(w.dir); err == nil && rel == dir {
+			dir = ""
+		}
+	}
+	if dir == w.target {
+		return
+	}
+	if w.target != "" {
+		w.watcher.Remove(w.target) // Might be gone already.
+	}
+	w.target = ""
+	if dir != "" && w.watcher.Add(dir) == nil {
+		w.target = dir
+	}
+}
+
+func (w *fsWatcher) Changes() <-chan struct{} {
+	return w.changes
+}
+
+func (w *fsWatcher) Close() error {
+	return w.watcher.Close()
+}
+
+// pollWatcher is a watcher that checks the file at regular intervals,
+// see fileState for how changes are detected.
+type pollWatcher struct {
+	file     string
+	interval time.Duration
+	changes  chan struct{}
+	quit     chan struct{}
+	state    fileState
+}
+
+func newPollWatcher(file string, interval time.Duration) *pollWatcher {
+	w := &pollWatcher{
+		file:     file,
+		interval: interval,
+		changes:  make(chan struct{}, 1),
+		quit:     make(chan struct{}),
+	}
+	w.state.update(file) // Record the initial state.
+	go w.run()
+	return w
+}
+
+func (w *pollWatcher) run() {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if w.state.update(w.file) {
+				notify(w.changes)
+			}
+		case <-w.quit:
+			return
+		}
+	}
+}
+
+func (w *pollWatcher) Changes() <-chan struct{} {
+	return w.changes
+}
+
+func (w *pollWatcher) Close() error {
+	close(w.quit)
+	return nil
+}
+
+func fileChecksum(name string) (string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := md5.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
@@ -0,0 +1,223 @@
+// Copyright 2009 The freegeoip authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package freegeoip
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fiorix/freegeoip/internal/testdb"
+)
+
+func TestPollWatcher(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "db.gz")
+	err := ioutil.WriteFile(file, []byte("first"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := newPollWatcher(file, 10*time.Millisecond)
+	defer w.Close()
+
+	// Touching the file without changing its content is not a change.
+	future := time.Now().Add(time.Hour)
+	err = os.Chtimes(file, future, future)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-w.Changes():
+		t.Fatal("Unexpected change for identical content")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	err = ioutil.WriteFile(file, []byte("second"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-w.Changes():
+	case <-time.After(time.Second):
+		t.Fatal("Timed out")
+	}
+}
+
+func TestPollWatcherMissingFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "db.gz")
+	w := newPollWatcher(file, 10*time.Millisecond)
+	defer w.Close()
+	err := ioutil.WriteFile(file, []byte("data"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-w.Changes():
+	case <-time.After(time.Second):
+		t.Fatal("Timed out")
+	}
+}
+
+func waitChange(t *testing.T, w watcher) {
+	t.Helper()
+	select {
+	case <-w.Changes():
+	case <-time.After(2 * time.Second):
+		t.Fatal("Timed out waiting for change")
+	}
+}
+
+func noChange(t *testing.T, w watcher) {
+	t.Helper()
+	select {
+	case <-w.Changes():
+		t.Fatal("Unexpected change")
+	case <-time.After(3 * debounceDelay):
+	}
+}
+
+// configMapUpdate mimics how the kubelet updates a volume: the content
+// is written to a new timestamped directory and the ..data symlink is
+// atomically swapped to point to it.
+func configMapUpdate(t *testing.T, dir, name, data string) {
+	t.Helper()
+	ts := filepath.Join(dir, "..2026_10_19_"+name)
+	err := os.Mkdir(ts, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(ts, "db.gz"), []byte(data), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old, _ := os.Readlink(filepath.Join(dir, "..data"))
+	tmp := filepath.Join(dir, "..data_tmp")
+	err = os.Symlink(filepath.Base(ts), tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Rename(tmp, filepath.Join(dir, "..data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if old != "" {
+		os.RemoveAll(filepath.Join(dir, old))
+	}
+}
+
+func TestFSWatcherConfigMap(t *testing.T) {
+	dir := t.TempDir()
+	configMapUpdate(t, dir, "a", "first")
+	file := filepath.Join(dir, "db.gz")
+	err := os.Symlink(filepath.Join("..data", "db.gz"), file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := newFSWatcher(file, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	configMapUpdate(t, dir, "b", "second")
+	waitChange(t, w)
+
+	// Same content delivered again is not a change.
+	configMapUpdate(t, dir, "c", "second")
+	noChange(t, w)
+
+	configMapUpdate(t, dir, "d", "third")
+	waitChange(t, w)
+}
+
+func TestFSWatcherRenameIntoPlace(t *testing.T) {
+	dir, staging := t.TempDir(), t.TempDir()
+	file := filepath.Join(dir, "db.gz")
+	err := ioutil.WriteFile(file, []byte("first"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := newFSWatcher(file, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	next := filepath.Join(staging, "db.gz")
+	err = ioutil.WriteFile(next, []byte("second"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Rename(next, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitChange(t, w)
+}
+
+func TestFSWatcherSymlinkTarget(t *testing.T) {
+	dir, data := t.TempDir(), t.TempDir()
+	target := filepath.Join(data, "real.gz")
+	err := ioutil.WriteFile(target, []byte("first"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(dir, "db.gz")
+	err = os.Symlink(target, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := newFSWatcher(file, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	// A burst of writes to the target in another directory is
+	// debounced into a single change.
+	for _, s := range []string{"s", "se", "sec", "second"} {
+		err = ioutil.WriteFile(target, []byte(s), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitChange(t, w)
+	noChange(t, w)
+}
+
+func TestWatchConfigMapReload(t *testing.T) {
+	dir := t.TempDir()
+	data, err := ioutil.ReadFile(testFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	configMapUpdate(t, dir, "a", string(data))
+	file := filepath.Join(dir, "db.gz")
+	err = os.Symlink(filepath.Join("..data", "db.gz"), file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	<-db.NotifyOpen() // Initial load.
+
+	// Same database, compressed with a different header.
+	var b bytes.Buffer
+	gz := gzip.NewWriter(&b)
+	gz.Name = "b"
+	gz.Write(testdb.Bytes())
+	gz.Close()
+	configMapUpdate(t, dir, "b", b.String())
+	select {
+	case <-db.NotifyOpen():
+	case <-time.After(2 * time.Second):
+		t.Fatal("Timed out")
+	}
+}